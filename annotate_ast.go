@@ -43,3 +43,14 @@ func annotateNodes(fset *token.FileSet, node0, node1 ast.Node, left, right strin
 		Right: []byte(right),
 	}
 }
+
+// deprecatedClass returns a class attribute that marks a header as deprecated,
+// if any of docs, the doc comments that apply to its declaration, says so.
+func deprecatedClass(docs ...*ast.CommentGroup) string {
+	for _, doc := range docs {
+		if doc != nil && isDeprecated(doc.Text()) {
+			return ` class="deprecated"`
+		}
+	}
+	return ""
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"compress/gzip"
+	"go/ast"
+	"go/build"
+	"go/token"
+	"go/types"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/shurcooL/frontend/select_menu"
+	"github.com/shurcooL/gtdo/gtdo"
+	"github.com/shurcooL/gtdo/internal/apidiff"
+	"github.com/shurcooL/gtdo/page"
+	"golang.org/x/net/http/httpguts"
+	"golang.org/x/tools/godoc/vfs"
+	"sourcegraph.com/sourcegraph/go-vcs/vcs"
+)
+
+// apiReport is a comparison of the exported API of a package between two revisions.
+type apiReport struct {
+	Base, Rev    string // Compared revisions.
+	BaseMissing  bool   // Whether the package doesn't exist at Base.
+	BaseError    string // Non-empty if the API at Base failed to load.
+	RevError     string // Non-empty if the API at Rev failed to load.
+	Incompatible []apidiff.Change
+	Compatible   []apidiff.Change
+
+	// Semver explains whether the changes are allowed by semantic versioning,
+	// if both revisions are version tags.
+	Semver          string
+	SemverViolation bool
+}
+
+func (h *handler) apiHandler(w http.ResponseWriter, req *http.Request, importPath, rev string) {
+	target := buildTargetFromQuery(req.URL.Query())
+	source, bpkg, repoSpec, repoImportPath, commit, fs, branches, defaultBranch, err := try(importPath, rev, target, h.permit(req))
+	log.Println("using source:", source)
+	if err != nil {
+		log.Println("try:", err)
+		tryError(w, err)
+		return
+	}
+
+	frontendState := page.State{
+		ImportPath:     importPath,
+		RepoImportPath: repoImportPath,
+		ProcessedRev:   rev,
+	}
+	if frontendState.ProcessedRev == "" && len(branches) != 0 {
+		frontendState.ProcessedRev = defaultBranch
+	}
+	if repoSpec != nil {
+		frontendState.RepoSpec.VCSType = repoSpec.vcsType
+		frontendState.RepoSpec.CloneURL = repoSpec.cloneURL
+	}
+	if commit != nil {
+		frontendState.CommitID = string(commit.ID)
+	}
+
+	data := struct {
+		FrontendState      page.State // TODO: Maybe move RawQuery, etc., here?
+		AnalyticsHTML      template.HTML
+		RawQuery           string
+		Tabs               template.HTML
+		ImportPath         string
+		ImportPathElements template.HTML // Import path with linkified elements.
+		RepoImportPath     string
+		Commit             *vcs.Commit
+		Unreachable        *updateFailure // Non-nil if the repository has been failing to update for a long time.
+		DirExists          bool
+		Bpkg               *build.Package
+		Folders            []string
+		Branches           template.HTML // Select menu for branches.
+		Platform           platformSelector
+		BaseBranches       template.HTML // Select menu for the base revision.
+		API                *apiReport
+	}{
+		FrontendState:      frontendState,
+		AnalyticsHTML:      h.analyticsHTML,
+		RawQuery:           req.URL.RawQuery,
+		Tabs:               page.Tabs(req.URL.Path, req.URL.RawQuery),
+		ImportPath:         importPath,
+		ImportPathElements: page.ImportPathElementsHTML(repoImportPath, importPath, req.URL.RawQuery),
+		RepoImportPath:     repoImportPath,
+		Commit:             commit,
+		Unreachable:        RepoUpdater.Unreachable(repoSpec),
+		DirExists:          fs != nil,
+		Bpkg:               bpkg,
+		Platform:           newPlatformSelector(req.URL.Query()),
+	}
+
+	// Folders.
+	if fs != nil {
+		fis, err := fs.ReadDir("/virtual-go-workspace/src/" + importPath)
+		if err != nil {
+			log.Println("fs.ReadDir(importPath):", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, fi := range fis {
+			if !fi.IsDir() {
+				continue
+			}
+			data.Folders = append(data.Folders, fi.Name())
+		}
+	}
+
+	// Branches.
+	if len(branches) != 0 {
+		data.Branches = select_menu.New(branches, defaultBranch, req.URL.Query(), gtdo.RevisionQueryParameter)
+		data.BaseBranches = select_menu.New(branches, defaultBranch, req.URL.Query(), gtdo.BaseQueryParameter)
+	}
+
+	if fs != nil && bpkg != nil {
+		base := req.URL.Query().Get(gtdo.BaseQueryParameter)
+		if base == "" {
+			base = defaultBranch
+		}
+		permit := h.permit(req)
+		baseSource, baseBpkg, _, _, baseCommit, baseFS, _, _, err := try(importPath, base, target, permit)
+		if err != nil {
+			log.Println("try base:", err)
+			tryError(w, err)
+			return
+		}
+		report := &apiReport{
+			Base: base,
+			Rev:  frontendState.ProcessedRev,
+		}
+		// A side that fails to load isn't compared, since comparing
+		// with an empty package would report all of the API as changed.
+		var old *types.Package
+		if baseFS != nil && baseBpkg != nil {
+			old, err = cachedAPIPackage(baseSource, baseFS, baseBpkg, baseCommit, target, permit)
+			if err != nil {
+				log.Println("cachedAPIPackage base:", err)
+				if isPermitError(err) {
+					tryError(w, err)
+					return
+				}
+				report.BaseError = err.Error()
+			}
+		} else {
+			report.BaseMissing = true
+			old = types.NewPackage(bpkg.ImportPath, bpkg.Name)
+		}
+		pkg, err := cachedAPIPackage(source, fs, bpkg, commit, target, permit)
+		if err != nil {
+			log.Println("cachedAPIPackage:", err)
+			if isPermitError(err) {
+				tryError(w, err)
+				return
+			}
+			report.RevError = err.Error()
+		}
+		if old != nil && pkg != nil {
+			for _, c := range apidiff.Diff(old, pkg) {
+				if c.Incompatible {
+					report.Incompatible = append(report.Incompatible, c)
+				} else {
+					report.Compatible = append(report.Compatible, c)
+				}
+			}
+			if baseVersion, version := apidiff.Version(report.Base), apidiff.Version(report.Rev); baseVersion != "" && version != "" {
+				changes := append(report.Incompatible[:len(report.Incompatible):len(report.Incompatible)], report.Compatible...)
+				violation, explanation, err := apidiff.CheckVersions(baseVersion, version, changes)
+				if err != nil {
+					explanation = "Can't check semantic versioning: " + err.Error() + "."
+				}
+				report.Semver, report.SemverViolation = explanation, violation
+			}
+		}
+		data.API = report
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	var wr io.Writer = w
+	if httpguts.HeaderValuesContainsToken(req.Header["Accept-Encoding"], "gzip") {
+		// Use gzip compression.
+		w.Header().Set("Content-Encoding", "gzip")
+		gw := gzip.NewWriter(w)
+		defer gw.Close()
+		wr = gw
+	}
+
+	err = t.ExecuteTemplate(wr, "api.html.tmpl", &data)
+	if err != nil {
+		log.Printf("t.ExecuteTemplate: %v\n", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	sendToTopMaybe(bpkg)
+	scheduleRefresh(importPath, repoSpec)
+}
+
+// apiPackages caches packages type-checked by apiPackage, since type-checking
+// the import closure of a package is costly, and both revisions are often
+// ones that were already compared, like the default branch.
+var apiPackages = newAPIPackageCache(50)
+
+// cachedAPIPackage returns the package returned by apiPackage for package bpkg
+// at commit, from apiPackages if possible. Type-checking is only done if permit
+// allows opTypeCheck. commit may be nil, in which case the package isn't cached.
+func cachedAPIPackage(source string, fs vfs.FileSystem, bpkg *build.Package, commit *vcs.Commit, target buildTarget, permit permitFunc) (*types.Package, error) {
+	var key apiPackageKey
+	if commit != nil {
+		key = apiPackageKey{commitID: commit.ID, importPath: bpkg.ImportPath, target: target.String()}
+		if pkg, ok := apiPackages.Get(key); ok {
+			return pkg, nil
+		}
+	}
+	if err := permit(opTypeCheck); err != nil {
+		return nil, err
+	}
+	pkg, err := apiPackage(source, fs, bpkg, target)
+	if err != nil {
+		return nil, err
+	}
+	if commit != nil {
+		apiPackages.Add(key, pkg)
+	}
+	return pkg, nil
+}
+
+type apiPackageKey struct {
+	commitID   vcs.CommitID
+	importPath string
+	target     string // String of buildTarget, since it's not comparable.
+}
+
+// apiPackageCache is a cache of type-checked packages, which holds up to max packages.
+// When it's full, the package that was added first is evicted.
+type apiPackageCache struct {
+	mu    sync.Mutex
+	max   int
+	pkgs  map[apiPackageKey]*types.Package
+	order []apiPackageKey // Keys of pkgs, in the order they were added.
+}
+
+func newAPIPackageCache(max int) *apiPackageCache {
+	return &apiPackageCache{max: max, pkgs: make(map[apiPackageKey]*types.Package)}
+}
+
+// Get returns the package cached for key, if any.
+func (c *apiPackageCache) Get(key apiPackageKey) (*types.Package, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pkg, ok := c.pkgs[key]
+	return pkg, ok
+}
+
+// Add caches pkg for key.
+func (c *apiPackageCache) Add(key apiPackageKey, pkg *types.Package) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.pkgs[key]; ok {
+		return
+	}
+	if len(c.order) >= c.max {
+		delete(c.pkgs, c.order[0])
+		c.order = c.order[1:]
+	}
+	c.pkgs[key] = pkg
+	c.order = append(c.order, key)
+}
+
+// apiPackage type-checks package bpkg from fs, a file system returned by try from source,
+// for comparing its API. Imports from fs are type-checked too, for the same build target,
+// and others are replaced with placeholders. It returns an error if the files
+// of bpkg can't be parsed, since its API can't be determined then.
+func apiPackage(source string, fs vfs.FileSystem, bpkg *build.Package, target buildTarget) (*types.Package, error) {
+	context := importContext(source, fs, target)
+	fset := token.NewFileSet()
+	imp := &apidiff.Importer{
+		Fset: fset,
+		Load: func(importPath string) ([]*ast.File, error) {
+			bpkg, err := context.Import(importPath, "", 0)
+			if err != nil {
+				return nil, err
+			}
+			return parseGoFileList(fs, fset, bpkg)
+		},
+	}
+	files, err := parseGoFileList(fs, fset, bpkg)
+	if err != nil {
+		return nil, err
+	}
+	return imp.Check(bpkg.ImportPath, files), nil
+}
+
+// parseGoFileList parses the non-test Go files of package bpkg, sorted by filename.
+func parseGoFileList(fs vfs.FileSystem, fset *token.FileSet, bpkg *build.Package) ([]*ast.File, error) {
+	filenames := append(bpkg.GoFiles[:len(bpkg.GoFiles):len(bpkg.GoFiles)], bpkg.CgoFiles...)
+	sort.Strings(filenames)
+	m, err := parseGoFiles(fs, fset, bpkg.Dir, filenames)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]*ast.File, 0, len(filenames))
+	for _, filename := range filenames {
+		files = append(files, m[filename])
+	}
+	return files, nil
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+
+	"github.com/shurcooL/gtdo/internal/ratelimit"
+)
+
+// botPolicy controls how bots and crawlers are treated.
+// It's loaded from a JSON file specified by -bot-policy-file flag.
+type botPolicy struct {
+	// Rules are matched against the User-Agent header of each request.
+	// The first matching rule applies.
+	Rules []*botRule
+
+	// CrawlersMayClone controls whether requests from crawlers
+	// may cause new repositories to be cloned.
+	CrawlersMayClone bool
+
+	// Packages is the set of import paths crawlers are allowed to visit.
+	// They're listed in robots.txt and sitemap.xml.
+	Packages []string
+
+	packages map[string]struct{} // Set of Packages.
+}
+
+// botRule is a rule for clients whose User-Agent matches a pattern.
+type botRule struct {
+	UserAgent string // Regular expression matched against User-Agent header.
+
+	Block   bool // Whether to block matching requests altogether.
+	Crawler bool // Whether matching clients are crawlers that must respect robots.txt.
+
+	PerIP ratelimit.Limit // Rate limit for each matching client IP.
+	PerUA ratelimit.Limit // Rate limit shared by all matching clients.
+
+	re        *regexp.Regexp
+	ipLimiter *ratelimit.Limiter
+	uaLimiter *ratelimit.Limiter
+}
+
+// defaultBotPolicy is used when no -bot-policy-file is specified.
+var defaultBotPolicy = botPolicy{
+	Rules: []*botRule{
+		{UserAgent: `Baiduspider`, Block: true},
+		{UserAgent: `AlphaBot`, Block: true},
+	},
+}
+
+// loadBotPolicy loads a bot policy from the JSON file at path.
+// If path is empty, defaultBotPolicy is used.
+func loadBotPolicy(path string) (*botPolicy, error) {
+	var p botPolicy
+	switch path {
+	case "":
+		p = defaultBotPolicy
+	default:
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		err = json.NewDecoder(f).Decode(&p)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s: %v", path, err)
+		}
+	}
+	for _, r := range p.Rules {
+		var err error
+		r.re, err = regexp.Compile(r.UserAgent)
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: %v", r.UserAgent, err)
+		}
+		r.ipLimiter = ratelimit.New(r.PerIP)
+		r.uaLimiter = ratelimit.New(r.PerUA)
+	}
+	p.packages = make(map[string]struct{}, len(p.Packages))
+	for _, importPath := range p.Packages {
+		p.packages[importPath] = struct{}{}
+	}
+	sort.Strings(p.Packages)
+	return &p, nil
+}
+
+// rule returns the first rule matching the request's User-Agent, or nil if none match.
+func (p *botPolicy) rule(req *http.Request) *botRule {
+	ua := req.UserAgent()
+	for _, r := range p.Rules {
+		if r.re.MatchString(ua) {
+			return r
+		}
+	}
+	return nil
+}
+
+// isCrawler reports whether req comes from a crawler.
+func (p *botPolicy) isCrawler(req *http.Request) bool {
+	r := p.rule(req)
+	return r != nil && r.Crawler
+}
+
+// Check checks req against the policy. If req should be served,
+// it returns true. Otherwise it writes an error response and returns false.
+func (p *botPolicy) Check(w http.ResponseWriter, req *http.Request, importPath string) bool {
+	r := p.rule(req)
+	if r == nil {
+		return true
+	}
+	if r.Block {
+		log.Printf("blocked request to %q from %q\n", req.URL.String(), req.UserAgent())
+		http.Error(w, "403 Forbidden\n\nsee robots.txt", http.StatusForbidden)
+		return false
+	}
+	if _, allowed := p.packages[importPath]; r.Crawler && !allowed {
+		log.Printf("blocked crawler request to %q from %q\n", req.URL.String(), req.UserAgent())
+		http.Error(w, "403 Forbidden\n\nsee robots.txt", http.StatusForbidden)
+		return false
+	}
+	if ok, retryAfter := r.ipLimiter.Allow(clientIP(req)); !ok {
+		tooManyRequests(w, retryAfter, "please retry later")
+		return false
+	}
+	if ok, retryAfter := r.uaLimiter.Allow(r.UserAgent); !ok {
+		tooManyRequests(w, retryAfter, "please retry later")
+		return false
+	}
+	return true
+}
+
+// errCloneNotPermitted is returned by try when a crawler
+// would cause a new repository to be cloned, but that's not permitted.
+var errCloneNotPermitted = errors.New("cloning new repositories is not permitted for crawlers")
+
+// Permit returns a permitFunc that applies the policy to operations done on behalf of req.
+func (p *botPolicy) Permit(req *http.Request) permitFunc {
+	crawler := p.isCrawler(req)
+	return func(op costlyOp) error {
+		if op == opClone && crawler && !p.CrawlersMayClone {
+			return errCloneNotPermitted
+		}
+		return nil
+	}
+}
+
+// RobotsTxt serves robots.txt that allows only p.Packages.
+func (p *botPolicy) RobotsTxt(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	io.WriteString(w, "User-agent: *\n")
+	for _, importPath := range p.Packages {
+		fmt.Fprintf(w, "Allow: /%s$\n", importPath)
+	}
+	io.WriteString(w, "Disallow: /\n")
+	if len(p.Packages) != 0 {
+		fmt.Fprintf(w, "\nSitemap: %s/sitemap.xml\n", baseURL(req))
+	}
+}
+
+// Sitemap serves sitemap.xml that lists p.Packages.
+func (p *botPolicy) Sitemap(w http.ResponseWriter, req *http.Request) {
+	if len(p.Packages) == 0 {
+		http.NotFound(w, req)
+		return
+	}
+	type url struct {
+		Loc string `xml:"loc"`
+	}
+	sitemap := struct {
+		XMLName xml.Name `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 urlset"`
+		URLs    []url    `xml:"url"`
+	}{}
+	for _, importPath := range p.Packages {
+		sitemap.URLs = append(sitemap.URLs, url{Loc: baseURL(req) + "/" + importPath})
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	io.WriteString(w, xml.Header)
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "\t")
+	err := enc.Encode(sitemap)
+	if err != nil {
+		log.Println("Sitemap:", err)
+	}
+}
+
+// baseURL returns the scheme and host that req was made to, e.g., "https://example.com".
+func baseURL(req *http.Request) string {
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + req.Host
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"go/build"
+	"html/template"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/shurcooL/frontend/checkbox"
+	"github.com/shurcooL/frontend/select_menu"
+	"github.com/shurcooL/gtdo/gtdo"
+)
+
+// Known values of GOOS and GOARCH, as listed by "go tool dist list".
+var (
+	knownGOOS = []string{
+		"aix", "android", "darwin", "dragonfly", "freebsd", "illumos", "ios", "js",
+		"linux", "netbsd", "openbsd", "plan9", "solaris", "wasip1", "windows",
+	}
+	knownGOARCH = []string{
+		"386", "amd64", "arm", "arm64", "loong64", "mips", "mips64", "mips64le",
+		"mipsle", "ppc64", "ppc64le", "riscv64", "s390x", "wasm",
+	}
+)
+
+// buildTarget is the platform and build tags that packages are resolved for.
+type buildTarget struct {
+	GOOS, GOARCH string
+	CgoEnabled   bool
+	Tags         []string
+}
+
+// buildTargetFromQuery returns the build target selected by query parameters.
+// It defaults to the server's own platform, without tags.
+// Unknown GOOS and GOARCH values and malformed tags are ignored.
+func buildTargetFromQuery(query url.Values) buildTarget {
+	t := buildTarget{
+		GOOS:       build.Default.GOOS,
+		GOARCH:     build.Default.GOARCH,
+		CgoEnabled: build.Default.CgoEnabled,
+	}
+	if goos := query.Get(gtdo.GOOSQueryParameter); contains(knownGOOS, goos) {
+		t.GOOS = goos
+	}
+	if goarch := query.Get(gtdo.GOARCHQueryParameter); contains(knownGOARCH, goarch) {
+		t.GOARCH = goarch
+	}
+	if _, toggle := query[gtdo.CgoQueryParameter]; toggle {
+		t.CgoEnabled = !t.CgoEnabled
+	}
+	for _, tag := range strings.Split(query.Get(gtdo.TagsQueryParameter), ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || strings.IndexFunc(tag, func(r rune) bool {
+			return !(r == '_' || r == '.' || 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9')
+		}) != -1 {
+			continue
+		}
+		t.Tags = append(t.Tags, tag)
+	}
+	return t
+}
+
+// String returns a description of t, like "linux/amd64 with cgo and tags foo,bar".
+func (t buildTarget) String() string {
+	s := t.GOOS + "/" + t.GOARCH
+	if t.CgoEnabled {
+		s += " with cgo"
+	} else {
+		s += " without cgo"
+	}
+	if len(t.Tags) != 0 {
+		s += " and tags " + strings.Join(t.Tags, ",")
+	}
+	return s
+}
+
+// apply sets up context to resolve packages for t.
+func (t buildTarget) apply(context *build.Context) {
+	context.GOOS = t.GOOS
+	context.GOARCH = t.GOARCH
+	context.CgoEnabled = t.CgoEnabled
+	context.BuildTags = t.Tags
+}
+
+func contains(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// platformSelector holds controls for selecting the build target of a page.
+type platformSelector struct {
+	GOOS   template.HTML // Select menu for GOOS.
+	GOARCH template.HTML // Select menu for GOARCH.
+	Cgo    template.HTML // Checkbox for cgo.
+	Tags   string        // Comma-separated build tags.
+
+	// Hidden are the other query parameters of the page, to be preserved
+	// when the build tags form is submitted.
+	Hidden []queryParameter
+}
+
+type queryParameter struct {
+	Name, Value string
+}
+
+// newPlatformSelector returns controls for selecting the build target,
+// set to the one selected by query.
+func newPlatformSelector(query url.Values) platformSelector {
+	s := platformSelector{
+		GOOS:   select_menu.New(knownGOOS, build.Default.GOOS, query, gtdo.GOOSQueryParameter),
+		GOARCH: select_menu.New(knownGOARCH, build.Default.GOARCH, query, gtdo.GOARCHQueryParameter),
+		Cgo:    checkbox.New(build.Default.CgoEnabled, query, gtdo.CgoQueryParameter),
+		Tags:   strings.Join(buildTargetFromQuery(query).Tags, ","),
+	}
+	var names []string
+	for name := range query {
+		if name != gtdo.TagsQueryParameter {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range query[name] {
+			s.Hidden = append(s.Hidden, queryParameter{Name: name, Value: value})
+		}
+	}
+	return s
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/token"
+	"log"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/shurcooL/gtdo/internal/sanitizedanchorname"
+	"github.com/sourcegraph/annotate"
+	"golang.org/x/tools/godoc/vfs"
+)
+
+// asmSymbol is the location of a function implemented in assembly.
+type asmSymbol struct {
+	File string // Name of the .s file.
+	Line int
+}
+
+// Anchor returns the anchor name of the line that defines s.
+func (s asmSymbol) Anchor() string {
+	return fmt.Sprintf("%s-L%d", sanitizedanchorname.Create(s.File), s.Line)
+}
+
+// asmTextRE matches TEXT directives that define functions of the package being assembled,
+// like "TEXT ·Sqrt(SB),NOSPLIT,$0" or "TEXT runtime·memmove<ABIInternal>(SB), NOSPLIT, $0-24".
+var asmTextRE = regexp.MustCompile(`^\s*TEXT\s+([^\s(·]*)·([\pL_][\pL\pN_]*)(?:<[^>]*>)?\(SB\)`)
+
+// asmSymbols returns the functions that the .s files of package bpkg implement, by name.
+// If a function is implemented more than once, the first implementation is used.
+func asmSymbols(fs vfs.FileSystem, bpkg *build.Package) map[string]asmSymbol {
+	symbols := make(map[string]asmSymbol)
+	for _, name := range bpkg.SFiles {
+		src, err := vfs.ReadFile(fs, path.Join(bpkg.Dir, name))
+		if err != nil {
+			log.Println("asmSymbols: vfs.ReadFile:", err)
+			continue
+		}
+		sc := bufio.NewScanner(bytes.NewReader(src))
+		for line := 1; sc.Scan(); line++ {
+			m := asmTextRE.FindStringSubmatch(sc.Text())
+			if m == nil || (m[1] != "" && m[1] != bpkg.Name) {
+				continue
+			}
+			if _, ok := symbols[m[2]]; !ok {
+				symbols[m[2]] = asmSymbol{File: name, Line: line}
+			}
+		}
+	}
+	return symbols
+}
+
+// cgoLinks returns annotations that link C.foo references in cgo file fileAst
+// to the lines of its preamble that declare foo. fileName is the name of the file.
+// References to names that aren't declared in the preamble, like ones from
+// included headers, aren't linked.
+func cgoLinks(fset *token.FileSet, fileAst *ast.File, fileName string) []*annotate.Annotation {
+	preamble := cgoPreamble(fileAst)
+	if preamble == nil {
+		return nil
+	}
+
+	lines := make(map[string]int) // Preamble line that declares each C name, or 0 if none.
+	declLine := func(name string) int {
+		if line, ok := lines[name]; ok {
+			return line
+		}
+		expr := name
+		for _, prefix := range []string{"struct_", "union_", "enum_"} {
+			if strings.HasPrefix(name, prefix) {
+				expr = strings.TrimSuffix(prefix, "_") + `\s+` + strings.TrimPrefix(name, prefix)
+				break
+			}
+		}
+		re := regexp.MustCompile(`\b` + expr + `\b`)
+		for _, c := range preamble.List {
+			start := fset.Position(c.Pos()).Line
+			for i, text := range strings.Split(c.Text, "\n") {
+				if strings.HasPrefix(strings.TrimSpace(strings.TrimPrefix(text, "//")), "#include") {
+					continue
+				}
+				if re.MatchString(text) {
+					lines[name] = start + i
+					return start + i
+				}
+			}
+		}
+		lines[name] = 0
+		return 0
+	}
+
+	var anns []*annotate.Annotation
+	ast.Inspect(fileAst, func(n ast.Node) bool {
+		sel, ok := n.(*ast.SelectorExpr)
+		if !ok {
+			return true
+		}
+		if x, ok := sel.X.(*ast.Ident); !ok || x.Name != "C" || x.Obj != nil {
+			return true
+		}
+		if line := declLine(sel.Sel.Name); line != 0 {
+			anns = append(anns, annotateNode(fset, sel.Sel, fmt.Sprintf(`<a href="#%s-L%d">`, sanitizedanchorname.Create(fileName), line), `</a>`, 1))
+		}
+		return false
+	})
+	return anns
+}
+
+// cgoPreamble returns the preamble of cgo file fileAst,
+// the doc comment of its import "C" declaration, or nil if there's none.
+func cgoPreamble(fileAst *ast.File) *ast.CommentGroup {
+	for _, decl := range fileAst.Decls {
+		d, ok := decl.(*ast.GenDecl)
+		if !ok || d.Tok != token.IMPORT {
+			continue
+		}
+		for _, spec := range d.Specs {
+			imp := spec.(*ast.ImportSpec)
+			if path, err := strconv.Unquote(imp.Path.Value); err != nil || path != "C" {
+				continue
+			}
+			if imp.Doc != nil {
+				return imp.Doc
+			}
+			if !d.Lparen.IsValid() {
+				return d.Doc
+			}
+			return nil
+		}
+	}
+	return nil
+}
@@ -25,17 +25,18 @@ func init() {
 }
 
 func (h *handler) dependentsHandler(w http.ResponseWriter, req *http.Request, importPath, rev string) {
-	source, bpkg, repoSpec, repoImportPath, commit, fs, branches, defaultBranch, err := try(importPath, rev)
+	source, bpkg, repoSpec, repoImportPath, commit, fs, branches, defaultBranch, err := try(importPath, rev, buildTargetFromQuery(req.URL.Query()), h.permit(req))
 	log.Println("using source:", source)
 	if err != nil {
 		log.Println("try:", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		tryError(w, err)
 		return
 	}
 
 	frontendState := page.State{
-		ImportPath:   importPath,
-		ProcessedRev: rev,
+		ImportPath:     importPath,
+		RepoImportPath: repoImportPath,
+		ProcessedRev:   rev,
 	}
 	if frontendState.ProcessedRev == "" && len(branches) != 0 {
 		frontendState.ProcessedRev = defaultBranch
@@ -56,6 +57,7 @@ func (h *handler) dependentsHandler(w http.ResponseWriter, req *http.Request, im
 		ImportPath         string
 		ImportPathElements template.HTML // Import path with linkified elements.
 		RepoImportPath     string
+		Unreachable        *updateFailure // Non-nil if the repository has been failing to update for a long time.
 		DirExists          bool
 		Bpkg               *build.Package
 		Dependents         gddo.Importers
@@ -68,6 +70,7 @@ func (h *handler) dependentsHandler(w http.ResponseWriter, req *http.Request, im
 		ImportPath:         importPath,
 		ImportPathElements: page.ImportPathElementsHTML(repoImportPath, importPath, req.URL.RawQuery),
 		RepoImportPath:     repoImportPath,
+		Unreachable:        RepoUpdater.Unreachable(repoSpec),
 		DirExists:          fs != nil,
 		Bpkg:               bpkg,
 	}
@@ -114,4 +117,5 @@ func (h *handler) dependentsHandler(w http.ResponseWriter, req *http.Request, im
 	}
 
 	sendToTopMaybe(bpkg)
+	scheduleRefresh(importPath, repoSpec)
 }
@@ -1,22 +1,27 @@
 package main
 
 import (
-	"bytes"
 	"compress/gzip"
+	"fmt"
 	"go/ast"
 	"go/build"
 	"go/doc"
 	"go/parser"
+	"go/scanner"
 	"go/token"
 	"html/template"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
+	"path"
 	"path/filepath"
 	"sort"
+	"strings"
 
 	"github.com/shurcooL/frontend/select_menu"
 	"github.com/shurcooL/gtdo/gtdo"
+	"github.com/shurcooL/gtdo/internal/sanitizedanchorname"
 	"github.com/shurcooL/gtdo/page"
 	"golang.org/x/net/http/httpguts"
 	"golang.org/x/tools/godoc/vfs"
@@ -24,17 +29,18 @@ import (
 )
 
 func (h *handler) summaryHandler(w http.ResponseWriter, req *http.Request, importPath, rev string) {
-	source, bpkg, repoSpec, repoImportPath, commit, fs, branches, defaultBranch, err := try(importPath, rev)
+	source, bpkg, repoSpec, repoImportPath, commit, fs, branches, defaultBranch, err := try(importPath, rev, buildTargetFromQuery(req.URL.Query()), h.permit(req))
 	log.Println("using source:", source)
 	if err != nil {
 		log.Println("try:", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		tryError(w, err)
 		return
 	}
 
 	frontendState := page.State{
-		ImportPath:   importPath,
-		ProcessedRev: rev,
+		ImportPath:     importPath,
+		RepoImportPath: repoImportPath,
+		ProcessedRev:   rev,
 	}
 	if frontendState.ProcessedRev == "" && len(branches) != 0 {
 		frontendState.ProcessedRev = defaultBranch
@@ -56,12 +62,15 @@ func (h *handler) summaryHandler(w http.ResponseWriter, req *http.Request, impor
 		ImportPathElements template.HTML // Import path with linkified elements.
 		RepoImportPath     string
 		Commit             *vcs.Commit
+		Unreachable        *updateFailure // Non-nil if the repository has been failing to update for a long time.
 		DirExists          bool
 		Bpkg               *build.Package
-		Dpkg               *doc.Package
-		DocHTML            template.HTML
+		Doc                *packageDoc
+		DocError           *docError // Non-nil if docs couldn't be built.
+		Readme             template.HTML
 		Folders            []string
 		Branches           template.HTML // Select menu for branches.
+		Platform           platformSelector
 	}{
 		FrontendState:      frontendState,
 		AnalyticsHTML:      h.analyticsHTML,
@@ -71,8 +80,10 @@ func (h *handler) summaryHandler(w http.ResponseWriter, req *http.Request, impor
 		ImportPathElements: page.ImportPathElementsHTML(repoImportPath, importPath, req.URL.RawQuery),
 		RepoImportPath:     repoImportPath,
 		Commit:             commit,
+		Unreachable:        RepoUpdater.Unreachable(repoSpec),
 		DirExists:          fs != nil,
 		Bpkg:               bpkg,
+		Platform:           newPlatformSelector(req.URL.Query()),
 	}
 
 	// Folders.
@@ -97,14 +108,18 @@ func (h *handler) summaryHandler(w http.ResponseWriter, req *http.Request, impor
 	}
 
 	if fs != nil && bpkg != nil {
-		if dpkg, err := docPackage(fs, bpkg); err == nil {
-			data.Dpkg = dpkg
-
-			var buf bytes.Buffer
-			doc.ToHTML(&buf, dpkg.Doc, nil)
-			data.DocHTML = template.HTML(buf.String())
+		if pdoc, err := docPackage(fs, bpkg, repoImportPath, req.URL.RawQuery); err == nil {
+			data.Doc = pdoc
 		} else {
 			log.Println(err)
+			data.DocError = newDocError(err, bpkg, req.URL.RawQuery)
+		}
+	}
+	if fs != nil {
+		if readme, err := readmeHTML(fs, importPath, repoImportPath, frontendState.ProcessedRev, req.URL.RawQuery); err == nil {
+			data.Readme = readme
+		} else {
+			log.Println("readmeHTML:", err)
 		}
 	}
 
@@ -126,20 +141,22 @@ func (h *handler) summaryHandler(w http.ResponseWriter, req *http.Request, impor
 	}
 
 	sendToTopMaybe(bpkg)
+	scheduleRefresh(importPath, repoSpec)
 }
 
 func (h *handler) importsHandler(w http.ResponseWriter, req *http.Request, importPath, rev string) {
-	source, bpkg, repoSpec, repoImportPath, commit, fs, branches, defaultBranch, err := try(importPath, rev)
+	source, bpkg, repoSpec, repoImportPath, commit, fs, branches, defaultBranch, err := try(importPath, rev, buildTargetFromQuery(req.URL.Query()), h.permit(req))
 	log.Println("using source:", source)
 	if err != nil {
 		log.Println("try:", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		tryError(w, err)
 		return
 	}
 
 	frontendState := page.State{
-		ImportPath:   importPath,
-		ProcessedRev: rev,
+		ImportPath:     importPath,
+		RepoImportPath: repoImportPath,
+		ProcessedRev:   rev,
 	}
 	if frontendState.ProcessedRev == "" && len(branches) != 0 {
 		frontendState.ProcessedRev = defaultBranch
@@ -161,10 +178,12 @@ func (h *handler) importsHandler(w http.ResponseWriter, req *http.Request, impor
 		ImportPathElements template.HTML // Import path with linkified elements.
 		RepoImportPath     string
 		Commit             *vcs.Commit
+		Unreachable        *updateFailure // Non-nil if the repository has been failing to update for a long time.
 		DirExists          bool
 		Bpkg               *build.Package
 		Folders            []string
 		Branches           template.HTML // Select menu for branches.
+		Platform           platformSelector
 
 		AdditionalTestImports []string
 	}{
@@ -176,8 +195,10 @@ func (h *handler) importsHandler(w http.ResponseWriter, req *http.Request, impor
 		ImportPathElements: page.ImportPathElementsHTML(repoImportPath, importPath, req.URL.RawQuery),
 		RepoImportPath:     repoImportPath,
 		Commit:             commit,
+		Unreachable:        RepoUpdater.Unreachable(repoSpec),
 		DirExists:          fs != nil,
 		Bpkg:               bpkg,
+		Platform:           newPlatformSelector(req.URL.Query()),
 	}
 
 	// Folders.
@@ -239,23 +260,84 @@ func (h *handler) importsHandler(w http.ResponseWriter, req *http.Request, impor
 	}
 
 	sendToTopMaybe(bpkg)
+	scheduleRefresh(importPath, repoSpec)
 }
 
-func docPackage(fs vfs.FileSystem, bpkg *build.Package) (*doc.Package, error) {
-	apkg, err := astPackage(fs, bpkg)
+// docPackage computes documentation of package bpkg, rendered for the Summary tab.
+// Links are made relative to repoImportPath and rawQuery of the current page.
+// Examples are collected from test files, if they can be parsed.
+func docPackage(fs vfs.FileSystem, bpkg *build.Package, repoImportPath, rawQuery string) (*packageDoc, error) {
+	fset, apkg, err := astPackage(fs, bpkg)
+	if err != nil {
+		return nil, err
+	}
+	var files []*ast.File
+	for _, f := range apkg.Files {
+		files = append(files, f)
+	}
+	var testFilenames []string
+	testFilenames = append(testFilenames, bpkg.TestGoFiles...)
+	testFilenames = append(testFilenames, bpkg.XTestGoFiles...)
+	if testFiles, err := parseGoFiles(fs, fset, bpkg.Dir, testFilenames); err == nil {
+		for _, f := range testFiles {
+			files = append(files, f)
+		}
+	} else {
+		log.Println("docPackage: parsing test files:", err)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return fset.Position(files[i].Package).Filename < fset.Position(files[j].Package).Filename
+	})
+	dpkg, err := doc.NewFromFiles(fset, files, bpkg.ImportPath)
 	if err != nil {
 		return nil, err
 	}
-	return doc.New(apkg, bpkg.ImportPath, 0), nil
+	r := newDocRenderer(fset, apkg, bpkg.ImportPath, repoImportPath, rawQuery)
+	return r.packageDoc(dpkg), nil
 }
 
-func astPackage(fs vfs.FileSystem, bpkg *build.Package) (*ast.Package, error) {
+// docError describes why the docs of a package couldn't be built.
+type docError struct {
+	Message string
+	CodeURL string // URL of the error location in the Code tab, if known.
+}
+
+// newDocError returns a description of err, returned by docPackage for package bpkg.
+// rawQuery is the query of the Summary tab.
+func newDocError(err error, bpkg *build.Package, rawQuery string) *docError {
+	e := &docError{
+		// Paths are relative to the package directory, like in the Code tab.
+		Message: strings.ReplaceAll(err.Error(), bpkg.Dir+"/", ""),
+	}
+	if list, ok := err.(scanner.ErrorList); ok && len(list) != 0 {
+		query, _ := url.ParseQuery(rawQuery)
+		query.Del("tab")
+		u := url.URL{
+			Path:     "/" + bpkg.ImportPath,
+			RawQuery: query.Encode(),
+			Fragment: fmt.Sprintf("%s-L%d", sanitizedanchorname.Create(path.Base(list[0].Pos.Filename)), list[0].Pos.Line),
+		}
+		e.CodeURL = u.String()
+	}
+	return e
+}
+
+func astPackage(fs vfs.FileSystem, bpkg *build.Package) (*token.FileSet, *ast.Package, error) {
 	// TODO: Either find a way to use golang.org/x/tools/importer directly, or do file AST parsing in parallel like it does
-	filenames := append(bpkg.GoFiles, bpkg.CgoFiles...)
-	files := make(map[string]*ast.File, len(filenames))
 	fset := token.NewFileSet()
+	files, err := parseGoFiles(fs, fset, bpkg.Dir, append(bpkg.GoFiles, bpkg.CgoFiles...))
+	if err != nil {
+		return nil, nil, err
+	}
+	return fset, &ast.Package{Name: bpkg.Name, Files: files}, nil
+}
+
+// parseGoFiles parses Go files with filenames in directory dir of fs.
+// The returned map is keyed by filename.
+func parseGoFiles(fs vfs.FileSystem, fset *token.FileSet, dir string, filenames []string) (map[string]*ast.File, error) {
+	files := make(map[string]*ast.File, len(filenames))
 	for _, filename := range filenames {
-		name := filepath.ToSlash(filepath.Join(bpkg.Dir, filename))
+		name := filepath.ToSlash(filepath.Join(dir, filename))
 		f, err := fs.Open(name)
 		if err != nil {
 			return nil, err
@@ -267,5 +349,5 @@ func astPackage(fs vfs.FileSystem, bpkg *build.Package) (*ast.Package, error) {
 		}
 		files[filename] = fileAst // TODO: Figure out if filename or full path are to be used (the key of this map doesn't seem to be used anywhere!)
 	}
-	return &ast.Package{Name: bpkg.Name, Files: files}, nil
+	return files, nil
 }
@@ -0,0 +1,490 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/doc"
+	"go/doc/comment"
+	"go/printer"
+	"go/scanner"
+	"go/token"
+	"html/template"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/shurcooL/go/printerutil"
+	"github.com/shurcooL/gtdo/internal/sanitizedanchorname"
+)
+
+// packageDoc is the documentation of a package, rendered for the Summary tab.
+type packageDoc struct {
+	Doc      template.HTML
+	Examples []docExample
+	Consts   []docValue
+	Vars     []docValue
+	Funcs    []docFunc
+	Types    []docType
+	Notes    []docNotes
+}
+
+// Empty reports whether there's no documentation at all.
+func (d *packageDoc) Empty() bool {
+	return d.Doc == "" && len(d.Examples) == 0 && len(d.Consts) == 0 && len(d.Vars) == 0 &&
+		len(d.Funcs) == 0 && len(d.Types) == 0 && len(d.Notes) == 0
+}
+
+// docValue is a documented group of constants or variables.
+type docValue struct {
+	Decl       template.HTML
+	Doc        template.HTML
+	Deprecated bool
+}
+
+// docFunc is a documented function or method.
+type docFunc struct {
+	ID         string // Anchor name, e.g., "Foo" or "T.Foo" for methods.
+	Title      string // E.g., "func Foo" or "func (*T) Foo".
+	Decl       template.HTML
+	Doc        template.HTML
+	Examples   []docExample
+	Deprecated bool
+}
+
+// docType is a documented type, along with its associated declarations.
+type docType struct {
+	ID       string
+	Decl     template.HTML
+	Doc      template.HTML
+	Examples []docExample
+	Consts   []docValue
+	Vars     []docValue
+	Funcs    []docFunc // Constructors, functions returning the type.
+	Methods  []docFunc
+
+	Deprecated bool
+}
+
+// docExample is an example function.
+type docExample struct {
+	Title     string // E.g., "Example" or "Example (Suffix)".
+	Doc       template.HTML
+	Code      string
+	Output    string // Expected output.
+	HasOutput bool   // Whether there's an output section, even if empty.
+	Unordered bool   // Whether the output is unordered.
+	CodeURL   string // URL of the example source in the Code tab, with tests displayed.
+}
+
+// docNotes are notes with the same marker, e.g., "BUG" or "TODO".
+type docNotes struct {
+	Marker string
+	Notes  []template.HTML
+}
+
+// docRenderer renders documentation of a package as HTML, with identifiers
+// in declarations linked to their definitions.
+type docRenderer struct {
+	fset           *token.FileSet
+	importPath     string
+	repoImportPath string
+	rawQuery       string
+
+	dpkg    *doc.Package                 // Package being rendered. Set by packageDoc.
+	files   map[string]*ast.File         // Filename -> file.
+	imports map[string]map[string]string // Filename -> package name -> import path.
+	names   map[string]bool              // Package-level names that are documented.
+}
+
+func newDocRenderer(fset *token.FileSet, apkg *ast.Package, importPath, repoImportPath, rawQuery string) *docRenderer {
+	r := &docRenderer{
+		fset:           fset,
+		importPath:     importPath,
+		repoImportPath: repoImportPath,
+		rawQuery:       rawQuery,
+		files:          make(map[string]*ast.File),
+		imports:        make(map[string]map[string]string),
+		names:          make(map[string]bool),
+	}
+	for _, f := range apkg.Files {
+		filename := fset.Position(f.Package).Filename
+		r.files[filename] = f
+		imports := make(map[string]string)
+		for _, imp := range f.Imports {
+			importPath, err := strconv.Unquote(imp.Path.Value)
+			if err != nil {
+				continue
+			}
+			name := importName(importPath)
+			if imp.Name != nil {
+				name = imp.Name.Name
+			}
+			imports[name] = importPath
+		}
+		r.imports[filename] = imports
+	}
+	return r
+}
+
+// majorVersionSuffix matches a major version suffix of an import path, like "/v2" or ".v3".
+var majorVersionSuffix = regexp.MustCompile(`[./]v[0-9]+$`)
+
+// importName guesses the package name of importPath, which is usually its last element.
+func importName(importPath string) string {
+	name := path.Base(majorVersionSuffix.ReplaceAllString(importPath, ""))
+	return strings.TrimPrefix(name, "go-")
+}
+
+// packageDoc renders dpkg.
+func (r *docRenderer) packageDoc(dpkg *doc.Package) *packageDoc {
+	r.dpkg = dpkg
+	for _, v := range append(dpkg.Consts, dpkg.Vars...) {
+		r.addNames(v.Names)
+	}
+	for _, f := range dpkg.Funcs {
+		r.names[f.Name] = true
+	}
+	for _, t := range dpkg.Types {
+		r.names[t.Name] = true
+		for _, v := range append(t.Consts, t.Vars...) {
+			r.addNames(v.Names)
+		}
+		for _, f := range t.Funcs {
+			r.names[f.Name] = true
+		}
+	}
+
+	d := &packageDoc{
+		Doc:      r.commentHTML(dpkg.Doc, packageHeadingLevel),
+		Examples: r.examples(dpkg.Examples),
+		Consts:   r.values(dpkg.Consts),
+		Vars:     r.values(dpkg.Vars),
+		Funcs:    r.funcs(dpkg.Funcs),
+	}
+	for _, t := range dpkg.Types {
+		d.Types = append(d.Types, docType{
+			ID:       t.Name,
+			Decl:     r.declHTML(t.Decl),
+			Doc:      r.docHTML(t.Doc),
+			Examples: r.examples(t.Examples),
+			Consts:   r.values(t.Consts),
+			Vars:     r.values(t.Vars),
+			Funcs:    r.funcs(t.Funcs),
+			Methods:  r.funcs(t.Methods),
+
+			Deprecated: isDeprecated(t.Doc),
+		})
+	}
+	var markers []string
+	for marker := range dpkg.Notes {
+		markers = append(markers, marker)
+	}
+	sort.Strings(markers)
+	for _, marker := range markers {
+		notes := docNotes{Marker: marker}
+		for _, n := range dpkg.Notes[marker] {
+			notes.Notes = append(notes.Notes, r.docHTML(n.Body))
+		}
+		d.Notes = append(d.Notes, notes)
+	}
+	return d
+}
+
+func (r *docRenderer) addNames(names []string) {
+	for _, name := range names {
+		r.names[name] = true
+	}
+}
+
+func (r *docRenderer) values(values []*doc.Value) []docValue {
+	var vs []docValue
+	for _, v := range values {
+		vs = append(vs, docValue{
+			Decl:       r.declHTML(v.Decl),
+			Doc:        r.docHTML(v.Doc),
+			Deprecated: isDeprecated(v.Doc),
+		})
+	}
+	return vs
+}
+
+func (r *docRenderer) funcs(funcs []*doc.Func) []docFunc {
+	var fs []docFunc
+	for _, f := range funcs {
+		id, title := f.Name, "func "+f.Name
+		if f.Recv != "" {
+			id = strings.TrimPrefix(f.Recv, "*") + "." + f.Name
+			title = fmt.Sprintf("func (%s) %s", f.Recv, f.Name)
+		}
+		fs = append(fs, docFunc{
+			ID:         id,
+			Title:      title,
+			Decl:       r.declHTML(f.Decl),
+			Doc:        r.docHTML(f.Doc),
+			Examples:   r.examples(f.Examples),
+			Deprecated: isDeprecated(f.Doc),
+		})
+	}
+	return fs
+}
+
+func (r *docRenderer) examples(examples []*doc.Example) []docExample {
+	var es []docExample
+	for _, e := range examples {
+		title := "Example"
+		if e.Suffix != "" {
+			title += " (" + e.Suffix + ")"
+		}
+		es = append(es, docExample{
+			Title:     title,
+			Doc:       r.docHTML(e.Doc),
+			Code:      r.exampleCode(e),
+			Output:    e.Output,
+			HasOutput: e.Output != "" || e.EmptyOutput,
+			Unordered: e.Unordered,
+			CodeURL:   r.exampleCodeURL(e),
+		})
+	}
+	return es
+}
+
+// outputPrefix matches the start of an output comment of an example.
+var outputPrefix = regexp.MustCompile(`(?i)^[[:space:]]*(unordered )?output:`)
+
+// exampleCode returns the formatted body of example e, without surrounding braces.
+// The output comment is left out, since the output is displayed separately.
+func (r *docRenderer) exampleCode(e *doc.Example) string {
+	var comments []*ast.CommentGroup
+	for _, c := range e.Comments {
+		if outputPrefix.MatchString(c.Text()) {
+			continue
+		}
+		comments = append(comments, c)
+	}
+	var buf bytes.Buffer
+	err := printerConfig.Fprint(&buf, r.fset, &printer.CommentedNode{Node: e.Code, Comments: comments})
+	if err != nil {
+		return ""
+	}
+	code := buf.String()
+	if _, ok := e.Code.(*ast.BlockStmt); ok {
+		code = strings.TrimSuffix(strings.TrimPrefix(code, "{\n"), "}")
+		code = strings.Replace(code, "\n\t", "\n", -1)
+		code = strings.TrimPrefix(code, "\t")
+	}
+	return strings.TrimSpace(code)
+}
+
+const (
+	// packageHeadingLevel is the level of headings in package documentation.
+	// They're <h2>, like headings of declarations, so they're part of the table of contents.
+	packageHeadingLevel = 2
+
+	// declHeadingLevel is the level of headings in documentation of declarations.
+	declHeadingLevel = 4
+)
+
+// docHTML renders doc comment text of a declaration as HTML.
+func (r *docRenderer) docHTML(text string) template.HTML {
+	return r.commentHTML(text, declHeadingLevel)
+}
+
+// isDeprecated reports whether doc comment text has a paragraph that starts
+// with "Deprecated:" followed by whitespace or the end of the text,
+// the convention for marking deprecated identifiers.
+func isDeprecated(text string) bool {
+	for _, para := range strings.Split(text, "\n\n") {
+		para = strings.TrimSpace(para)
+		if !strings.HasPrefix(para, "Deprecated:") {
+			continue
+		}
+		rest := para[len("Deprecated:"):]
+		if r, _ := utf8.DecodeRuneInString(rest); rest == "" || unicode.IsSpace(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// commentHTML renders doc comment text as HTML, with headings at headingLevel.
+// Doc links are resolved to gtdo URLs at the current revision.
+func (r *docRenderer) commentHTML(text string, headingLevel int) template.HTML {
+	if text == "" {
+		return ""
+	}
+	p := r.dpkg.Printer()
+	p.HeadingLevel = headingLevel
+	p.DocLinkURL = r.docLinkURL
+	return template.HTML(p.HTML(r.dpkg.Parser().Parse(text)))
+}
+
+// docLinkURL returns the URL of doc link, like [Name], [T.Name] or [pkg.Name].
+// Links within the package point to the declaration on the same page.
+func (r *docRenderer) docLinkURL(link *comment.DocLink) string {
+	var id string
+	switch {
+	case link.Recv != "":
+		id = link.Recv + "." + link.Name
+	default:
+		id = link.Name
+	}
+	if link.ImportPath == "" || link.ImportPath == r.importPath {
+		return "#" + id
+	}
+	u := string(importPathURL(link.ImportPath, r.repoImportPath, r.rawQuery))
+	if id != "" {
+		u += "#" + id
+	}
+	return u
+}
+
+var printerConfig = printer.Config{Mode: printer.UseSpaces | printer.TabIndent, Tabwidth: 8}
+
+// identLink is where an identifier in a declaration links to.
+type identLink struct {
+	href string // Empty if it doesn't link anywhere.
+	id   string // Anchor name to give the identifier, if any.
+}
+
+// declHTML formats decl as HTML, with identifiers of package-level names linked
+// to their definitions in the Code tab, and identifiers from other packages
+// linked to those packages.
+func (r *docRenderer) declHTML(decl ast.Decl) template.HTML {
+	filename := r.fset.Position(decl.Pos()).Filename
+	var node interface{} = decl
+	if f, ok := r.files[filename]; ok {
+		node = &printer.CommentedNode{Node: decl, Comments: f.Comments}
+	}
+	var buf bytes.Buffer
+	err := printerConfig.Fprint(&buf, r.fset, node)
+	if err != nil {
+		return template.HTML(template.HTMLEscapeString(err.Error()))
+	}
+	src := buf.Bytes()
+
+	// Identifiers are printed in the same order as ast.Inspect visits them.
+	links := r.identLinks(decl, r.imports[filename])
+
+	var out bytes.Buffer
+	file := token.NewFileSet().AddFile("", -1, len(src))
+	var s scanner.Scanner
+	s.Init(file, src, nil, 0)
+	last, i := 0, 0
+	for {
+		pos, tok, lit := s.Scan()
+		if tok == token.EOF {
+			break
+		}
+		if tok != token.IDENT {
+			continue
+		}
+		offset := file.Offset(pos)
+		template.HTMLEscape(&out, src[last:offset])
+		last = offset + len(lit)
+		var link identLink
+		if i < len(links) {
+			link = links[i]
+		}
+		i++
+		switch {
+		case link.href != "" && link.id != "":
+			fmt.Fprintf(&out, `<a id="%s" href="%s">%s</a>`, template.HTMLEscapeString(link.id), template.HTMLEscapeString(link.href), lit)
+		case link.href != "":
+			fmt.Fprintf(&out, `<a href="%s">%s</a>`, template.HTMLEscapeString(link.href), lit)
+		default:
+			out.WriteString(lit)
+		}
+	}
+	template.HTMLEscape(&out, src[last:])
+	return template.HTML(out.String())
+}
+
+// identLinks returns links of all identifiers in decl, in the order ast.Inspect visits them.
+// imports maps package names to import paths in the file of decl.
+func (r *docRenderer) identLinks(decl ast.Decl, imports map[string]string) []identLink {
+	// Identifiers that are being declared, rather than referred to.
+	defs := make(map[*ast.Ident]identLink)
+	ast.Inspect(decl, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.FuncDecl:
+			id := n.Name.Name
+			if n.Recv != nil && len(n.Recv.List) > 0 {
+				// Same as anchor names in the Code tab.
+				id = strings.TrimPrefix(printerutil.SprintAstBare(n.Recv.List[0].Type), "*") + "." + id
+			}
+			defs[n.Name] = identLink{href: r.codeURL(id)}
+		case *ast.TypeSpec:
+			defs[n.Name] = identLink{href: r.codeURL(n.Name.Name)}
+		case *ast.ValueSpec:
+			for _, name := range n.Names {
+				defs[name] = identLink{href: r.codeURL(name.Name), id: name.Name}
+			}
+		case *ast.Field:
+			// Field, parameter and result names don't link anywhere.
+			for _, name := range n.Names {
+				defs[name] = identLink{}
+			}
+		}
+		return true
+	})
+
+	var links []identLink
+	ast.Inspect(decl, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.SelectorExpr:
+			x, ok := n.X.(*ast.Ident)
+			if !ok {
+				break
+			}
+			importPath, ok := imports[x.Name]
+			if !ok {
+				break
+			}
+			pkgURL := string(importPathURL(importPath, r.repoImportPath, r.rawQuery))
+			links = append(links, identLink{href: pkgURL}, identLink{href: pkgURL + "#" + n.Sel.Name})
+			return false
+		case *ast.Ident:
+			if link, ok := defs[n]; ok {
+				links = append(links, link)
+			} else if r.names[n.Name] {
+				links = append(links, identLink{href: r.codeURL(n.Name)})
+			} else {
+				links = append(links, identLink{})
+			}
+		}
+		return true
+	})
+	return links
+}
+
+// exampleCodeURL returns the URL of lines of example e in the Code tab, with tests displayed.
+func (r *docRenderer) exampleCodeURL(e *doc.Example) string {
+	start, end := r.fset.Position(e.Code.Pos()), r.fset.Position(e.Code.End())
+	query, _ := url.ParseQuery(r.rawQuery)
+	query.Del("tab")
+	query.Set("tests", "")
+	u := url.URL{
+		Path:     "/" + r.importPath,
+		RawQuery: query.Encode(),
+		Fragment: fmt.Sprintf("%s-L%d-L%d", sanitizedanchorname.Create(path.Base(start.Filename)), start.Line, end.Line),
+	}
+	return u.String()
+}
+
+// codeURL returns the URL of the declaration with anchor name id in the Code tab.
+func (r *docRenderer) codeURL(id string) string {
+	query, _ := url.ParseQuery(r.rawQuery)
+	query.Del("tab")
+	u := url.URL{
+		Path:     "/" + r.importPath,
+		RawQuery: query.Encode(),
+		Fragment: id,
+	}
+	return u.String()
+}
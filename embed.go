@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"go/build"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"golang.org/x/tools/godoc/vfs"
+)
+
+// resolveEmbedPatterns resolves the //go:embed patterns of package bpkg against
+// its directory in fs. It returns the files matched by each pattern, relative
+// to the package directory. Test patterns are resolved only if includeTestFiles is true.
+func resolveEmbedPatterns(fs vfs.FileSystem, bpkg *build.Package, includeTestFiles bool) map[string][]string {
+	patterns := bpkg.EmbedPatterns
+	if includeTestFiles {
+		patterns = append(patterns[:len(patterns):len(patterns)], bpkg.TestEmbedPatterns...)
+		patterns = append(patterns, bpkg.XTestEmbedPatterns...)
+	}
+	embedded := make(map[string][]string)
+	for _, pattern := range patterns {
+		if _, ok := embedded[pattern]; ok {
+			continue
+		}
+		files, err := embedFiles(fs, bpkg.Dir, pattern)
+		if err != nil {
+			log.Printf("embedFiles(%q): %v\n", pattern, err)
+		}
+		embedded[pattern] = files
+	}
+	return embedded
+}
+
+// embeddedFileList returns the files in embedded, sorted and without duplicates.
+func embeddedFileList(embedded map[string][]string) []string {
+	seen := make(map[string]bool)
+	var files []string
+	for _, matched := range embedded {
+		for _, f := range matched {
+			if !seen[f] {
+				seen[f] = true
+				files = append(files, f)
+			}
+		}
+	}
+	sort.Strings(files)
+	return files
+}
+
+// embedFiles returns the files in dir that //go:embed pattern matches, relative to dir.
+// Like the go command, it includes all files within matched directories, except
+// ones whose names begin with '.' or '_', unless the pattern has an "all:" prefix.
+func embedFiles(fs vfs.FileSystem, dir, pattern string) ([]string, error) {
+	all := strings.HasPrefix(pattern, "all:")
+	glob := strings.TrimPrefix(pattern, "all:")
+	if _, err := path.Match(glob, ""); err != nil || glob == "" || glob == "." || strings.HasPrefix(glob, "/") {
+		return nil, fmt.Errorf("invalid pattern syntax")
+	}
+	for _, elem := range strings.Split(glob, "/") {
+		if elem == "" || elem == "." || elem == ".." {
+			return nil, fmt.Errorf("invalid pattern syntax")
+		}
+	}
+
+	var files []string
+	var walk func(rel string) error
+	walk = func(rel string) error {
+		fis, err := fs.ReadDir(path.Join(dir, rel))
+		if err != nil {
+			return err
+		}
+		for _, fi := range fis {
+			name := fi.Name()
+			if !all && (strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_")) {
+				continue
+			}
+			switch {
+			case fi.IsDir():
+				if _, err := fs.Stat(path.Join(dir, rel, name, "go.mod")); err == nil {
+					// Directories of other modules are never embedded.
+					continue
+				}
+				if err := walk(path.Join(rel, name)); err != nil {
+					return err
+				}
+			case fi.Mode().IsRegular():
+				files = append(files, path.Join(rel, name))
+			}
+		}
+		return nil
+	}
+
+	// Match the pattern one element at a time, like path/filepath.Glob.
+	matches := []string{"."}
+	for _, elem := range strings.Split(glob, "/") {
+		var next []string
+		for _, m := range matches {
+			fis, err := fs.ReadDir(path.Join(dir, m))
+			if err != nil {
+				continue
+			}
+			for _, fi := range fis {
+				if ok, _ := path.Match(elem, fi.Name()); ok {
+					next = append(next, path.Join(m, fi.Name()))
+				}
+			}
+		}
+		matches = next
+	}
+	for _, m := range matches {
+		fi, err := fs.Stat(path.Join(dir, m))
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case fi.IsDir():
+			if err := walk(m); err != nil {
+				return nil, err
+			}
+		case fi.Mode().IsRegular():
+			files = append(files, m)
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// embedArg is a pattern argument of a //go:embed directive.
+type embedArg struct {
+	Pattern string
+	Offset  int // Offset of the argument within the directive comment.
+	Len     int // Length of the argument, including quotes.
+}
+
+// embedDirectiveArgs returns the arguments of comment text,
+// if it's a //go:embed directive. Arguments can be quoted.
+func embedDirectiveArgs(text string) []embedArg {
+	const prefix = "//go:embed"
+	if !strings.HasPrefix(text, prefix) || len(text) == len(prefix) || !unicode.IsSpace(rune(text[len(prefix)])) {
+		return nil
+	}
+	var args []embedArg
+	for i := len(prefix); i < len(text); {
+		if unicode.IsSpace(rune(text[i])) {
+			i++
+			continue
+		}
+		var arg string
+		switch text[i] {
+		case '"', '`':
+			quoted, err := strconv.QuotedPrefix(text[i:])
+			if err != nil {
+				return args
+			}
+			arg = quoted
+			if p, err := strconv.Unquote(quoted); err == nil {
+				args = append(args, embedArg{Pattern: p, Offset: i, Len: len(arg)})
+			}
+		default:
+			arg = text[i:]
+			if j := strings.IndexFunc(arg, unicode.IsSpace); j != -1 {
+				arg = arg[:j]
+			}
+			args = append(args, embedArg{Pattern: arg, Offset: i, Len: len(arg)})
+		}
+		i += len(arg)
+	}
+	return args
+}
@@ -1,10 +1,22 @@
 package main
 
 import (
+	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
+	"path"
+	"strings"
 	"sync"
+	"time"
+
+	"github.com/shurcooL/gtdo/page"
+	"golang.org/x/net/websocket"
+	"sourcegraph.com/sourcegraph/go-vcs/vcs"
 )
 
 type importPathBranch struct {
@@ -13,71 +25,163 @@ type importPathBranch struct {
 }
 
 var (
-	sseMu sync.Mutex
-	sse   map[importPathBranch][]pageViewer
+	sseHeartbeatFlag           = flag.Duration("sse-heartbeat", 30*time.Second, "Interval between heartbeats sent on idle event streams. Zero disables heartbeats.")
+	sseMaxConnectionsFlag      = flag.Int("sse-max-connections", 10000, "Maximum number of open event streams. Zero means unlimited.")
+	sseMaxConnectionsPerIPFlag = flag.Int("sse-max-connections-per-ip", 20, "Maximum number of open event streams per client IP. Zero means unlimited.")
 )
 
+var (
+	sseMu        sync.Mutex
+	sse          map[importPathBranch][]pageViewer
+	sseConns     int            // Number of open event streams.
+	sseConnsIP   map[string]int // Client IP -> number of open event streams.
+	recentEvents []sentEvent    // Most recent events, oldest first, for replay to reconnecting clients.
+
+	// lastEventID is the ID of the last event sent. Before any is sent, it's
+	// an ID that no event has, so that streams always have a cursor to resume
+	// from. Since it's not in the replay buffer, all buffered events are
+	// considered missed by viewers that resume from it, see replayMissed.
+	lastEventID = busOrigin + "-0"
+
+	// sseDrain is closed when the server is shutting down,
+	// which makes all event streams end.
+	sseDrain = make(chan struct{})
+)
+
+const (
+	// maxRecentEvents and maxRecentEventAge bound the size of the replay buffer.
+	maxRecentEvents   = 100
+	maxRecentEventAge = 5 * time.Minute
+)
+
+// sentEvent is an event that was sent to page viewers of a repository branch.
+type sentEvent struct {
+	outdatedEvent
+	repoSpec repoSpec
+	sent     time.Time
+	affected map[importPathBranch]bool // Whether directories of viewed packages changed, where known.
+}
+
+// forPackage returns the event to notify viewers of package ipb of,
+// and whether they should be notified. Viewers of packages that are known
+// to be unaffected aren't. Others are, with PackageChanged set if it's known
+// that the package changed.
+func (e sentEvent) forPackage(ipb importPathBranch) (_ outdatedEvent, notify bool) {
+	changed, known := e.affected[ipb]
+	if known && !changed {
+		return outdatedEvent{}, false
+	}
+	event := e.outdatedEvent
+	event.PackageChanged = changed
+	return event, true
+}
+
+// outdatedEvent is an event with its ID.
+type outdatedEvent struct {
+	ID string // Bus-wide ID, the same on all instances. See changeMessage.
+	page.OutdatedEvent
+}
+
 type pageViewer struct {
 	id       *http.ResponseWriter
-	outdated chan struct{}
+	repoSpec repoSpec // Repository of the viewed package.
+	dir      string   // Directory of the viewed package, relative to repository root.
+	outdated chan outdatedEvent
 }
 
 // NotifyOutdated is called by repo updater when the given page viewer is outdated.
-// It returns immediately.
-func (pv *pageViewer) NotifyOutdated() {
-	select {
-	case pv.outdated <- struct{}{}:
-	default:
+// It returns immediately. If an earlier event hasn't been sent yet, it's replaced.
+func (pv *pageViewer) NotifyOutdated(event outdatedEvent) {
+	for {
+		select {
+		case pv.outdated <- event:
+			return
+		default:
+		}
+		select {
+		case <-pv.outdated:
+		default:
+		}
 	}
 }
 
-func eventsHandler(w http.ResponseWriter, req *http.Request) {
-	if req.Method != "GET" {
-		w.Header().Set("Allow", "GET")
-		http.Error(w, "405 Method Not Allowed\n\nmethod should be GET", http.StatusMethodNotAllowed)
-		return
-	}
+// eventStream is a page viewer's subscription to events.
+type eventStream struct {
+	Events <-chan outdatedEvent
+	Cursor string // ID of the last event sent before the stream was opened. It's never empty.
+
+	close func()
+}
 
+// Close unregisters the page viewer.
+func (s *eventStream) Close() { s.close() }
+
+// openEventStream registers a page viewer of the package specified by req query.
+// lastID is the ID of the last event the viewer received, or empty for a new viewer.
+// If the viewer can't be registered, it writes an error response to w and returns nil.
+func openEventStream(w http.ResponseWriter, req *http.Request, lastID string) *eventStream {
 	query := req.URL.Query()
 
-	importPath := query.Get("ImportPath")
 	importPathBranch := importPathBranch{
-		importPath: importPath,
+		importPath: query.Get("ImportPath"),
 		branch:     query.Get("Branch"),
 	}
-	importPathRepoSpec := importPathRepoSpec{
-		importPath: importPath,
-		repoSpec: repoSpec{
-			vcsType:  query.Get("RepoSpec.VCSType"),
-			cloneURL: query.Get("RepoSpec.CloneURL"),
-		},
-	}
-	if importPathRepoSpec.importPath == "" || importPathRepoSpec.vcsType == "" || importPathRepoSpec.cloneURL == "" {
+	importPathRepoSpec, ok := parseImportPathRepoSpec(query)
+	if !ok {
 		log.Println("Invalid importPathRepoSpec:", importPathRepoSpec)
 		http.Error(w, "Invalid importPathRepoSpec.", http.StatusBadRequest)
-		return
-	}
-	RepoUpdater.Enqueue(importPathRepoSpec)
-
-	flusher, ok := w.(http.Flusher)
-	if !ok {
-		log.Println("Streaming unsupported.")
-		http.Error(w, "Streaming unsupported.", http.StatusInternalServerError)
-		return
+		return nil
 	}
 
-	outdatedChan := make(chan struct{}, 1)
+	ip := clientIP(req)
+	outdatedChan := make(chan outdatedEvent, 1)
+	var (
+		viewers int
+		cursor  string
+	)
 	{
-		log.Println("Client connection joined:", &w)
 		sseMu.Lock()
-		sse[importPathBranch] = append(sse[importPathBranch], pageViewer{
+		switch {
+		case *sseMaxConnectionsFlag > 0 && sseConns >= *sseMaxConnectionsFlag:
+			sseMu.Unlock()
+			log.Println("Too many event streams, rejecting client:", ip)
+			w.Header().Set("Retry-After", "60")
+			http.Error(w, "503 Service Unavailable\n\ntoo many open event streams", http.StatusServiceUnavailable)
+			return nil
+		case *sseMaxConnectionsPerIPFlag > 0 && sseConnsIP[ip] >= *sseMaxConnectionsPerIPFlag:
+			sseMu.Unlock()
+			log.Println("Too many event streams from client:", ip)
+			tooManyRequests(w, time.Minute, "too many open event streams")
+			return nil
+		}
+		log.Println("Client connection joined:", &w)
+		sseConns++
+		sseConnsIP[ip]++
+		pv := pageViewer{
 			id:       &w,
+			repoSpec: importPathRepoSpec.repoSpec,
+			dir:      packageDir(importPathBranch.importPath, query.Get("RepoImportPath")),
 			outdated: outdatedChan,
-		})
+		}
+		sse[importPathBranch] = append(sse[importPathBranch], pv)
+		if lastID != "" {
+			replayMissed(pv, importPathBranch, lastID)
+		}
+		viewers = viewerCount(importPathBranch.importPath)
+		cursor = lastEventID
 		sseMu.Unlock()
 	}
-	defer func() {
+	if lastID == "" {
+		// Repositories with more viewers are updated first.
+		// Resumed streams are not new views, so they don't cause updates.
+		RepoUpdater.Enqueue(importPathRepoSpec, viewers*priorityViewer)
+	}
+	closeStream := func() {
 		sseMu.Lock()
+		sseConns--
+		if sseConnsIP[ip]--; sseConnsIP[ip] == 0 {
+			delete(sseConnsIP, ip)
+		}
 		for i, pv := range sse[importPathBranch] {
 			if pv.id == &w {
 				// Delete without preserving order.
@@ -92,7 +196,32 @@ func eventsHandler(w http.ResponseWriter, req *http.Request) {
 			}
 		}
 		sseMu.Unlock()
-	}()
+	}
+	return &eventStream{Events: outdatedChan, Cursor: cursor, close: closeStream}
+}
+
+// eventsHandler streams events to a page viewer using server-sent events.
+func eventsHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "405 Method Not Allowed\n\nmethod should be GET", http.StatusMethodNotAllowed)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		log.Println("Streaming unsupported.")
+		http.Error(w, "Streaming unsupported.", http.StatusInternalServerError)
+		return
+	}
+
+	// EventSource sends ID of the last event it received when reconnecting.
+	lastID := req.Header.Get("Last-Event-ID")
+	stream := openEventStream(w, req, lastID)
+	if stream == nil {
+		return
+	}
+	defer stream.Close()
 
 	w.Header().Set("Content-Type", "text/event-stream")
 	/*w.Header().Set("Cache-Control", "no-cache")
@@ -102,19 +231,351 @@ func eventsHandler(w http.ResponseWriter, req *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "https://gotools.org")
 	}*/
 
+	// Let the frontend know the stream works. If a proxy buffers the response,
+	// this doesn't arrive, and the frontend falls back to another transport.
+	// It has the stream's cursor as ID, so that EventSource resumes from it
+	// when reconnecting, even if no event was received before.
+	_, err := fmt.Fprintf(w, "id: %s\nevent: ready\ndata: \n\n", stream.Cursor)
+	if err != nil {
+		log.Println("(via write error:", err)
+		return
+	}
+	flusher.Flush()
+
+	// Send heartbeats, so that idle streams aren't closed by proxies,
+	// and clients that have gone away are noticed.
+	heartbeat, stopHeartbeat := heartbeatTicker()
+	defer stopHeartbeat()
+
 	for {
 		select {
-		case <-outdatedChan:
-			_, err := fmt.Fprintf(w, "data: %s\n\n", "outdated")
+		case event := <-stream.Events:
+			data, err := json.Marshal(event.OutdatedEvent)
+			if err != nil {
+				log.Println("json.Marshal:", err)
+				return
+			}
+			_, err = fmt.Fprintf(w, "id: %s\ndata: %s\n\n", event.ID, data)
 			if err != nil {
 				log.Println("(via write error:", err)
 				return
 			}
 
 			flusher.Flush()
+		case <-heartbeat:
+			_, err := fmt.Fprint(w, ": heartbeat\n\n")
+			if err != nil {
+				log.Println("(via heartbeat write error:", err)
+				return
+			}
+			flusher.Flush()
+		case <-sseDrain:
+			log.Println("(via server shutdown)")
+			return
 		case <-req.Context().Done():
 			log.Println("(via Context.Done)")
 			return
 		}
 	}
 }
+
+// heartbeatTicker returns a channel that delivers a tick for each heartbeat
+// an event stream sends, and a function that stops it. If heartbeats are
+// disabled, the channel is nil, so it never delivers.
+func heartbeatTicker() (<-chan time.Time, func()) {
+	if *sseHeartbeatFlag == 0 {
+		return nil, func() {}
+	}
+	t := time.NewTicker(*sseHeartbeatFlag)
+	return t.C, t.Stop
+}
+
+// wsEventsHandler streams events to a page viewer over WebSocket,
+// for clients behind proxies that buffer server-sent events.
+// Each message is a JSON-encoded page.EventMessage.
+func wsEventsHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "405 Method Not Allowed\n\nmethod should be GET", http.StatusMethodNotAllowed)
+		return
+	}
+
+	lastID := req.URL.Query().Get("LastEventID")
+	stream := openEventStream(w, req, lastID)
+	if stream == nil {
+		return
+	}
+	defer stream.Close()
+
+	websocket.Handler(func(ws *websocket.Conn) {
+		// Detect when the client closes the connection. It doesn't send anything else.
+		closed := make(chan struct{})
+		go func() {
+			io.Copy(ioutil.Discard, ws)
+			close(closed)
+		}()
+
+		// The first message lets the frontend know the connection works.
+		err := websocket.JSON.Send(ws, page.EventMessage{ID: stream.Cursor})
+		if err != nil {
+			log.Println("(via write error:", err)
+			return
+		}
+
+		heartbeat, stopHeartbeat := heartbeatTicker()
+		defer stopHeartbeat()
+
+		for {
+			var msg page.EventMessage
+			select {
+			case event := <-stream.Events:
+				msg = page.EventMessage{ID: event.ID, Event: &event.OutdatedEvent}
+			case <-heartbeat:
+				msg = page.EventMessage{}
+			case <-sseDrain:
+				log.Println("(via server shutdown)")
+				return
+			case <-closed:
+				log.Println("(via WebSocket close)")
+				return
+			}
+			err := websocket.JSON.Send(ws, msg)
+			if err != nil {
+				log.Println("(via write error:", err)
+				return
+			}
+		}
+	}).ServeHTTP(w, req)
+}
+
+// pollTimeout is how long a long polling request waits for an event.
+const pollTimeout = 30 * time.Second
+
+// pollEventsHandler waits for the next event for a page viewer, and responds
+// with a JSON-encoded page.EventMessage. If there's no event within pollTimeout,
+// the message has no event, only an ID to pass as LastEventID in the next request.
+// It's used by clients for which neither server-sent events nor WebSocket work.
+func pollEventsHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "405 Method Not Allowed\n\nmethod should be GET", http.StatusMethodNotAllowed)
+		return
+	}
+
+	lastID := req.URL.Query().Get("LastEventID")
+	stream := openEventStream(w, req, lastID)
+	if stream == nil {
+		return
+	}
+	defer stream.Close()
+
+	// The cursor is never empty, so the next poll resumes from it, and it's
+	// replayed events sent in between. Only the first poll is a new view.
+	msg := page.EventMessage{ID: stream.Cursor}
+	timeout := time.NewTimer(pollTimeout)
+	defer timeout.Stop()
+	select {
+	case event := <-stream.Events:
+		msg = page.EventMessage{ID: event.ID, Event: &event.OutdatedEvent}
+	case <-timeout.C:
+	case <-sseDrain:
+	case <-req.Context().Done():
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	err := json.NewEncoder(w).Encode(msg)
+	if err != nil {
+		log.Println("pollEventsHandler: json.Encode:", err)
+	}
+}
+
+// replayMissed notifies pv of the most recent event for its repository branch
+// that was sent after the event with lastID, if any. Newer events supersede
+// older ones, so there's no need to replay them all. If the event with lastID
+// isn't in the replay buffer, all events in it are considered missed.
+// sseMu must be held.
+func replayMissed(pv pageViewer, ipb importPathBranch, lastID string) {
+	missed := recentEvents
+	for i := len(recentEvents) - 1; i >= 0; i-- {
+		if recentEvents[i].ID == lastID {
+			missed = recentEvents[i+1:]
+			break
+		}
+	}
+	for i := len(missed) - 1; i >= 0; i-- {
+		e := missed[i]
+		if e.repoSpec != pv.repoSpec || e.Branch != ipb.branch {
+			continue
+		}
+		// Packages that weren't viewed at the time are assumed to be affected.
+		event, notify := e.forPackage(ipb)
+		if !notify {
+			return
+		}
+		log.Println("replaying missed event to:", ipb)
+		pv.NotifyOutdated(event)
+		return
+	}
+}
+
+// recordEvent adds event to the replay buffer, and drops old events from it.
+// sseMu must be held.
+func recordEvent(event sentEvent) {
+	recentEvents = append(recentEvents, event)
+	var drop int
+	for drop < len(recentEvents) && (len(recentEvents)-drop > maxRecentEvents || time.Since(recentEvents[drop].sent) > maxRecentEventAge) {
+		drop++
+	}
+	if drop > 0 {
+		recentEvents = append(recentEvents[:0:0], recentEvents[drop:]...)
+	}
+}
+
+// drainEvents ends all event streams. It's called when the server is shutting down,
+// since otherwise long-lived streams would keep it from finishing a graceful shutdown.
+func drainEvents() {
+	close(sseDrain)
+}
+
+// notifyAffected notifies viewers of packages in repository rs that are affected by event.
+// A package is affected unless its directory is known to be the same in the old
+// and new commits. Viewers of unaffected packages are not notified.
+// id is the bus-wide ID of event.
+func notifyAffected(repo vcs.Repository, rs repoSpec, id string, event page.OutdatedEvent) {
+	// Find viewed packages of the repository branch. Their directories are checked
+	// for changes outside of sseMu, since that requires reading from repo.
+	viewed := make(map[importPathBranch]string) // -> Package directory.
+	sseMu.Lock()
+	for importPathBranch, pageViewers := range sse {
+		if importPathBranch.branch != event.Branch {
+			continue
+		}
+		for _, pv := range pageViewers {
+			if pv.repoSpec == rs {
+				viewed[importPathBranch] = pv.dir
+				break
+			}
+		}
+	}
+	sseMu.Unlock()
+	affected := make(map[importPathBranch]bool, len(viewed))
+	for importPathBranch, dir := range viewed {
+		if changed, ok := packageChanged(repo, dir, event); ok {
+			affected[importPathBranch] = changed
+		}
+	}
+
+	sseMu.Lock()
+	lastEventID = id
+	sent := sentEvent{outdatedEvent: outdatedEvent{ID: id, OutdatedEvent: event}, repoSpec: rs, sent: time.Now(), affected: affected}
+	recordEvent(sent)
+	for importPathBranch, pageViewers := range sse {
+		if importPathBranch.branch != event.Branch {
+			continue
+		}
+		// Packages that started being viewed after the check are assumed to be affected.
+		idEvent, notify := sent.forPackage(importPathBranch)
+		if !notify {
+			fmt.Println("not notifying unaffected:", importPathBranch)
+			continue
+		}
+		for _, pv := range pageViewers {
+			if pv.repoSpec == rs {
+				pv.NotifyOutdated(idEvent)
+			}
+		}
+	}
+	sseMu.Unlock()
+}
+
+// packageChanged reports whether the package in directory dir changed in event.
+// ok is false if that can't be determined.
+// repo may be nil if the repository isn't available.
+func packageChanged(repo vcs.Repository, dir string, event page.OutdatedEvent) (changed, ok bool) {
+	if repo == nil || dir == "" || event.OldCommitID == "" || event.NewCommitID == "" {
+		// Unknown package directory, or new or deleted branch.
+		return false, false
+	}
+	changed, err := dirChanged(repo, dir, vcs.CommitID(event.OldCommitID), vcs.CommitID(event.NewCommitID))
+	if err != nil {
+		log.Println("packageChanged: dirChanged:", err)
+		return false, false
+	}
+	return changed, true
+}
+
+// packageDir returns the directory of package importPath relative to the root
+// of repository repoImportPath, or empty string if it can't be determined.
+func packageDir(importPath, repoImportPath string) string {
+	switch {
+	case isLocal(importPath):
+		// GOROOT repository.
+		return path.Join("/src", importPath)
+	case repoImportPath != "" && packageInsideRepo(importPath, repoImportPath):
+		return path.Join("/", strings.TrimPrefix(importPath, repoImportPath))
+	default:
+		return ""
+	}
+}
+
+// viewerCount returns the number of page viewers of importPath, across all branches.
+// sseMu must be held.
+func viewerCount(importPath string) int {
+	var n int
+	for ipb, pageViewers := range sse {
+		if ipb.importPath == importPath {
+			n += len(pageViewers)
+		}
+	}
+	return n
+}
+
+// parseImportPathRepoSpec parses an importPathRepoSpec from query.
+// It reports whether all of its fields are non-empty.
+func parseImportPathRepoSpec(query url.Values) (_ importPathRepoSpec, ok bool) {
+	rs := importPathRepoSpec{
+		importPath: query.Get("ImportPath"),
+		repoSpec: repoSpec{
+			vcsType:  query.Get("RepoSpec.VCSType"),
+			cloneURL: query.Get("RepoSpec.CloneURL"),
+		},
+	}
+	return rs, rs.importPath != "" && rs.vcsType != "" && rs.cloneURL != ""
+}
+
+// refreshHandler handles explicit requests from users to update a repository,
+// made with the "Check for updates" link on package pages.
+// Such updates are given higher priority than ones requested by page viewers.
+// Repositories that aren't in the vcs store yet are charged as clones.
+func (h *handler) refreshHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "405 Method Not Allowed\n\nmethod should be POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	importPathRepoSpec, ok := parseImportPathRepoSpec(req.URL.Query())
+	if !ok {
+		log.Println("Invalid importPathRepoSpec:", importPathRepoSpec)
+		http.Error(w, "Invalid importPathRepoSpec.", http.StatusBadRequest)
+		return
+	}
+	cloneURL, err := url.Parse(importPathRepoSpec.cloneURL)
+	if err != nil {
+		http.Error(w, "400 Bad Request\n\ninvalid clone URL", http.StatusBadRequest)
+		return
+	}
+	op := opFetch
+	if !vs.Contains(importPathRepoSpec.vcsType, cloneURL) {
+		op = opClone
+	}
+	if err := h.permit(req)(op); err != nil {
+		tryError(w, err)
+		return
+	}
+	RepoUpdater.Enqueue(importPathRepoSpec, priorityRefresh)
+
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"go/build"
+	"go/parser"
+	"go/token"
+	"io"
+	"io/ioutil"
+	"log"
+	"path"
+	"sort"
+	"strings"
+)
+
+// fileClass is a class of files in a package directory,
+// depending on whether and why they're part of the package.
+type fileClass int
+
+const (
+	includedFile           fileClass = iota // Part of the package.
+	cgoFile                                 // Part of the package, built with cgo.
+	testFile                                // Test file in the package.
+	xtestFile                               // Test file in the external test package.
+	constraintExcludedFile                  // Excluded by a build constraint.
+	filenameExcludedFile                    // Excluded by a GOOS or GOARCH file name suffix.
+	cgoExcludedFile                         // Excluded because it imports "C", and cgo is disabled.
+	ignoredFile                             // Excluded for another reason.
+	otherFile                               // Not a Go file.
+)
+
+// fileGroup is a group of files of the same class, sorted by name.
+type fileGroup struct {
+	Class fileClass
+	Files []string
+}
+
+// Heading returns the heading of the group.
+// It's empty for included files, since they need no introduction.
+func (g fileGroup) Heading() string {
+	switch g.Class {
+	case cgoFile:
+		return "Cgo files"
+	case testFile:
+		return "Test files"
+	case xtestFile:
+		return "External test files"
+	case constraintExcludedFile:
+		return "Excluded by build constraints"
+	case filenameExcludedFile:
+		return "Excluded by file name"
+	case cgoExcludedFile:
+		return "Excluded because cgo is disabled"
+	case ignoredFile:
+		return "Ignored files"
+	case otherFile:
+		return "Other files"
+	default:
+		return ""
+	}
+}
+
+// Explanation explains why files of the group are or aren't
+// part of package bpkg, when built for target.
+func (g fileGroup) Explanation(bpkg *build.Package, target buildTarget) string {
+	switch g.Class {
+	case cgoFile:
+		return `They import "C", and are built with cgo.`
+	case testFile:
+		return "They're built only by go test, as part of the package."
+	case xtestFile:
+		return fmt.Sprintf("They're built only by go test, as package %s_test.", bpkg.Name)
+	case constraintExcludedFile:
+		return fmt.Sprintf("Their //go:build constraints aren't satisfied for %v.", target)
+	case filenameExcludedFile:
+		return fmt.Sprintf("Their _GOOS or _GOARCH file name suffixes don't match GOOS=%s and GOARCH=%s.", target.GOOS, target.GOARCH)
+	case cgoExcludedFile:
+		return `They import "C", which requires cgo.`
+	case ignoredFile:
+		return "They're ignored by go/build for another reason, such as a different package clause."
+	case otherFile:
+		return "They're in the package directory, but aren't Go files."
+	default:
+		return ""
+	}
+}
+
+// classifyFiles groups files in the directory of package bpkg by class.
+// context is the build context that bpkg was imported with.
+// Go test files, including excluded ones, are left out unless includeTestFiles is true.
+// Empty groups are omitted.
+func classifyFiles(context build.Context, bpkg *build.Package, includeTestFiles bool) []fileGroup {
+	files := map[fileClass][]string{
+		includedFile: bpkg.GoFiles,
+		cgoFile:      bpkg.CgoFiles,
+	}
+	if includeTestFiles {
+		files[testFile] = bpkg.TestGoFiles
+		files[xtestFile] = bpkg.XTestGoFiles
+	}
+	for _, name := range bpkg.IgnoredGoFiles {
+		isTest := strings.HasSuffix(name, "_test.go") // Logic from go/build.
+		if isTest && !includeTestFiles {
+			continue
+		}
+		class := excludedFileClass(context, bpkg.Dir, name)
+		files[class] = append(files[class], name)
+	}
+	fis, err := context.ReadDir(bpkg.Dir)
+	if err != nil {
+		log.Println("classifyFiles: context.ReadDir:", err)
+	}
+	for _, fi := range fis {
+		if fi.IsDir() || strings.HasSuffix(fi.Name(), ".go") {
+			continue
+		}
+		files[otherFile] = append(files[otherFile], fi.Name())
+	}
+
+	var groups []fileGroup
+	for class := includedFile; class <= otherFile; class++ {
+		if len(files[class]) == 0 {
+			continue
+		}
+		names := append([]string(nil), files[class]...)
+		sort.Strings(names)
+		groups = append(groups, fileGroup{Class: class, Files: names})
+	}
+	return groups
+}
+
+// excludedFileClass determines why Go file name in dir was excluded from a package
+// imported with context. It uses context.MatchFile on stand-ins for the file,
+// to tell apart the reasons that MatchFile doesn't report.
+func excludedFileClass(context build.Context, dir, name string) fileClass {
+	matches := func(content string) bool {
+		c := context
+		c.OpenFile = func(string) (io.ReadCloser, error) {
+			return ioutil.NopCloser(strings.NewReader(content)), nil
+		}
+		ok, err := c.MatchFile(dir, name)
+		return err == nil && ok
+	}
+	if !matches("package p\n") {
+		return filenameExcludedFile
+	}
+
+	f, err := context.OpenFile(path.Join(dir, name))
+	if err != nil {
+		return ignoredFile
+	}
+	src, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return ignoredFile
+	}
+	if expr := buildConstraint(src); expr != "" && !matches("//go:build "+expr+"\n\npackage p\n") {
+		return constraintExcludedFile
+	}
+	if !context.CgoEnabled {
+		fileAst, _ := parser.ParseFile(token.NewFileSet(), name, src, parser.ImportsOnly)
+		if fileAst != nil {
+			for _, imp := range fileAst.Imports {
+				if imp.Path.Value == `"C"` {
+					return cgoExcludedFile
+				}
+			}
+		}
+	}
+	return ignoredFile
+}
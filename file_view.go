@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/scanner"
+	"html"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/dustin/go-humanize"
+	"github.com/shurcooL/github_flavored_markdown"
+	"github.com/shurcooL/gtdo/internal/sanitizedanchorname"
+	"github.com/sourcegraph/annotate"
+	"github.com/sourcegraph/syntaxhighlight"
+	"golang.org/x/tools/godoc/vfs"
+)
+
+// maxAnnotateSize is the size of the largest file that is annotated.
+// Larger files are displayed as plain text.
+const maxAnnotateSize = 1000 * 1000
+
+// maxOtherFileSize is the size of the largest non-Go file that is displayed.
+// Larger files are linked to instead, so they're not read into memory.
+const maxOtherFileSize = maxAnnotateSize
+
+// sniffSize is how much of a file is read to tell whether it's binary.
+const sniffSize = 8000
+
+// highlightedExts are extensions of non-Go files that are syntax highlighted.
+// The highlighter is language-agnostic, so it's only used for file types
+// with C-like tokens, where it does a reasonable job.
+var highlightedExts = map[string]bool{
+	".s": true, ".c": true, ".h": true, ".cc": true, ".cpp": true, ".cxx": true, ".hh": true, ".hpp": true,
+	".m": true, ".mm": true, ".f": true, ".swig": true, ".swigcxx": true,
+	".proto": true, ".js": true, ".ts": true, ".css": true, ".html": true, ".tmpl": true, ".json": true,
+	".yaml": true, ".yml": true, ".toml": true, ".sh": true, ".bash": true, ".py": true, ".xml": true,
+	".sql": true, ".mod": true, ".work": true,
+}
+
+// highlightedNames are names of non-Go files without an extension that are syntax highlighted.
+var highlightedNames = map[string]bool{
+	"Makefile":   true,
+	"Dockerfile": true,
+}
+
+// writeFileHeader writes the opening of file name's section, with its header.
+// attrs are extra attributes of the header. The section must be closed by the caller.
+func writeFileHeader(buf *bytes.Buffer, name, attrs string) {
+	fmt.Fprintf(buf, `<div><h2 id="%s"%s>%s<a class="anchor" onclick="MustScrollTo(event, &#34;\&#34;%s\&#34;&#34;);"><span class="anchor-icon">%s</span></a></h2>`, sanitizedanchorname.Create(name), attrs, html.EscapeString(name), sanitizedanchorname.Create(name), linkOcticon) // HACK.
+}
+
+// writeFileSource writes the source of file name with line numbers, and closes its section.
+// annSrc is the annotated source, which is HTML escaped if shouldHTMLEscape is true.
+// folds are the non-overlapping folds of the file, whose text annSrc marks with foldAnnotations.
+// errs are syntax errors in the file, whose lines are marked and which are listed after the source.
+func writeFileSource(buf *bytes.Buffer, name string, src, annSrc []byte, shouldHTMLEscape bool, folds []fold, errs scanner.ErrorList) {
+	errorLines := make(map[int]string) // Line -> first syntax error on it.
+	for _, e := range errs {
+		if _, ok := errorLines[e.Pos.Line]; !ok {
+			errorLines[e.Pos.Line] = e.Msg
+		}
+	}
+	foldStarts := make(map[int]fold)
+	foldEnds := make(map[int]bool)
+	for _, f := range folds {
+		foldStarts[f.StartLine] = f
+		foldEnds[f.EndLine] = true
+	}
+
+	lineCount := bytes.Count(src, []byte("\n"))
+	io.WriteString(buf, `<div class="highlight">`)
+	io.WriteString(buf, `<div class="background"></div>`)
+	io.WriteString(buf, `<div class="selection"></div>`)
+	io.WriteString(buf, `<table cellspacing=0><tr><td><pre class="ln">`)
+	inFold := false
+	for i := 1; i <= lineCount; i++ {
+		f, foldStart := foldStarts[i]
+		if foldStart {
+			fmt.Fprintf(buf, `<span class="fold-toggle" data-fold="%s" onclick="ToggleFold(event, &#34;\&#34;%s\&#34;&#34;);"></span>`, f.id(name), f.id(name))
+		}
+		if msg, ok := errorLines[i]; ok {
+			fmt.Fprintf(buf, `<span id="%s-L%d" class="ln syntax-error" title="%s" onclick="LineNumber(event, &#34;\&#34;%s-L%d\&#34;&#34;);">%d</span>`, sanitizedanchorname.Create(name), i, html.EscapeString(msg), sanitizedanchorname.Create(name), i, i)
+		} else {
+			fmt.Fprintf(buf, `<span id="%s-L%d" class="ln" onclick="LineNumber(event, &#34;\&#34;%s-L%d\&#34;&#34;);">%d</span>`, sanitizedanchorname.Create(name), i, sanitizedanchorname.Create(name), i, i)
+		}
+		buf.WriteString("\n")
+		// Lines after the opening delimiter of a fold, up to its closing one, are folded with it.
+		if foldEnds[i] && inFold {
+			io.WriteString(buf, `</span>`)
+			inFold = false
+		}
+		if foldStart {
+			fmt.Fprintf(buf, `<span class="fold-lines" data-fold="%s">`, f.id(name))
+			inFold = true
+		}
+	}
+	if inFold {
+		io.WriteString(buf, `</span>`)
+	}
+	io.WriteString(buf, `</pre></td><td><pre class="file">`)
+	switch shouldHTMLEscape {
+	case false:
+		buf.Write(annSrc)
+	case true:
+		template.HTMLEscape(buf, annSrc)
+	}
+	io.WriteString(buf, `</pre></td></tr></table>`)
+	if len(errs) != 0 {
+		io.WriteString(buf, `<ul class="syntax-errors">`)
+		for _, e := range errs {
+			fmt.Fprintf(buf, `<li><a href="#%s-L%d">%s:%d:%d</a>: %s</li>`, sanitizedanchorname.Create(name), e.Pos.Line, html.EscapeString(name), e.Pos.Line, e.Pos.Column, html.EscapeString(e.Msg))
+		}
+		io.WriteString(buf, `</ul>`)
+	}
+	io.WriteString(buf, `</div></div>`)
+}
+
+// syntaxErrorAnnotations returns annotations that show messages of syntax errors errs
+// at the end of their lines in src.
+func syntaxErrorAnnotations(src []byte, errs scanner.ErrorList) []*annotate.Annotation {
+	var anns []*annotate.Annotation
+	for _, e := range errs {
+		if e.Pos.Offset > len(src) {
+			continue
+		}
+		i := bytes.IndexByte(src[e.Pos.Offset:], '\n')
+		if i == -1 {
+			// The last line has no line number to show it on.
+			continue
+		}
+		anns = append(anns, &annotate.Annotation{
+			Start: e.Pos.Offset + i,
+			End:   e.Pos.Offset + i,
+
+			Left: []byte(fmt.Sprintf(`<span class="syntax-error" data-message="%s"></span>`, html.EscapeString(e.Msg))),
+		})
+	}
+	return anns
+}
+
+// writeOtherFile writes the section of non-Go file name in directory dir of fs.
+// Markdown files are rendered, binary and large files are described and linked
+// to at rawHref, and text files are displayed like Go files, syntax highlighted
+// if their type is known. Only the start of binary and large files is read.
+func writeOtherFile(buf *bytes.Buffer, fs vfs.FileSystem, dir, name string, fi os.FileInfo, rawHref string) error {
+	f, err := fs.Open(path.Join(dir, name))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	writeFileHeader(buf, name, "")
+	if fi.Size() > maxOtherFileSize {
+		start := make([]byte, sniffSize)
+		n, err := io.ReadFull(f, start)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		kind := "Large file"
+		if isBinary(start[:n]) {
+			kind = "Binary file"
+		}
+		fmt.Fprintf(buf, `<div class="file-note">%s, %s. <a href="%s">View raw</a>.</div></div>`, kind, humanize.Bytes(uint64(fi.Size())), html.EscapeString(rawHref))
+		return nil
+	}
+	src, err := ioutil.ReadAll(f)
+	if err != nil {
+		return err
+	}
+
+	ext := strings.ToLower(path.Ext(name))
+	switch {
+	case isBinary(src):
+		fmt.Fprintf(buf, `<div class="file-note">Binary file, %s. <a href="%s">View raw</a>.</div></div>`, humanize.Bytes(uint64(len(src))), html.EscapeString(rawHref))
+	case ext == ".md" || ext == ".markdown":
+		io.WriteString(buf, `<div class="markdown-body">`)
+		buf.Write(github_flavored_markdown.Markdown(src))
+		io.WriteString(buf, `</div></div>`)
+	case highlightedExts[ext] || highlightedNames[name]:
+		anns, err := syntaxhighlight.Annotate(src, htmlAnnotator)
+		_ = err // TODO: Deal with returned error.
+		sort.Sort(anns)
+		annSrc, err := annotate.Annotate(src, anns, template.HTMLEscape)
+		if err != nil {
+			writeFileSource(buf, name, src, src, true, nil, nil)
+			return nil
+		}
+		writeFileSource(buf, name, src, annSrc, false, nil, nil)
+	default:
+		writeFileSource(buf, name, src, src, true, nil, nil)
+	}
+	return nil
+}
+
+// isBinary reports whether src, which may be the start of a file's contents,
+// looks like the contents of a binary file.
+func isBinary(src []byte) bool {
+	if bytes.IndexByte(src, 0) != -1 {
+		return true
+	}
+	// Leave out a rune that may have been cut off at the end of src.
+	for i := 1; i < utf8.UTFMax && i <= len(src); i++ {
+		if utf8.RuneStart(src[len(src)-i]) {
+			if !utf8.FullRune(src[len(src)-i:]) {
+				src = src[:len(src)-i]
+			}
+			break
+		}
+	}
+	return !utf8.Valid(src)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+
+	"github.com/shurcooL/gtdo/internal/sanitizedanchorname"
+	"github.com/sourcegraph/annotate"
+)
+
+// fold is a region of a file that can be folded, like a function body.
+type fold struct {
+	Start, End         int // Byte offsets of the folded text, between its delimiters.
+	StartLine, EndLine int // Lines of the opening and closing delimiters.
+}
+
+// id returns the ID of the fold in file name.
+func (f fold) id(name string) string {
+	return fmt.Sprintf("%s-F%d", sanitizedanchorname.Create(name), f.StartLine)
+}
+
+// goFolds returns the function bodies and import blocks of fileAst, parsed from src,
+// that span multiple lines, in order. If fileAst has syntax errors, blocks that
+// are missing a delimiter aren't included.
+func goFolds(fset *token.FileSet, fileAst *ast.File, src []byte) []fold {
+	var folds []fold
+	add := func(open, close token.Pos) {
+		if !open.IsValid() || !close.IsValid() {
+			return
+		}
+		f := fold{
+			Start:     fileOffset(fset, open) + 1,
+			End:       fileOffset(fset, close),
+			StartLine: fset.Position(open).Line,
+			EndLine:   fset.Position(close).Line,
+		}
+		if f.End >= len(src) || !isFoldDelimiters(src[f.Start-1], src[f.End]) {
+			return
+		}
+		if f.EndLine > f.StartLine {
+			folds = append(folds, f)
+		}
+	}
+	for _, decl := range fileAst.Decls {
+		switch d := decl.(type) {
+		case *ast.FuncDecl:
+			if d.Body != nil {
+				add(d.Body.Lbrace, d.Body.Rbrace)
+			}
+		case *ast.GenDecl:
+			if d.Tok == token.IMPORT {
+				add(d.Lparen, d.Rparen)
+			}
+		}
+	}
+	return folds
+}
+
+// isFoldDelimiters reports whether open and close delimit a fold.
+func isFoldDelimiters(open, close byte) bool {
+	return open == '{' && close == '}' || open == '(' && close == ')'
+}
+
+// foldAnnotations returns annotations that mark the folded text of folds in file name.
+// When a fold is folded, its text is replaced by an ellipsis.
+func foldAnnotations(name string, folds []fold) []*annotate.Annotation {
+	var anns []*annotate.Annotation
+	for _, f := range folds {
+		anns = append(anns, &annotate.Annotation{
+			Start: f.Start,
+			End:   f.End,
+
+			Left:  []byte(fmt.Sprintf(`<span class="fold-body" data-fold="%s">`, f.id(name))),
+			Right: []byte(fmt.Sprintf(`</span><span class="fold-ellipsis" data-fold="%s" onclick="ToggleFold(event, &#34;\&#34;%s\&#34;&#34;);"></span>`, f.id(name), f.id(name))),
+		})
+	}
+	return anns
+}
@@ -0,0 +1,184 @@
+//go:build js
+// +build js
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gopherjs/eventsource"
+	"github.com/gopherjs/gopherjs/js"
+	"github.com/gopherjs/websocket/websocketjs"
+	"github.com/shurcooL/gtdo/page"
+)
+
+const (
+	// readyTimeout is how long a transport has to show that it works,
+	// before the next one is tried.
+	readyTimeout = 10 * time.Second
+
+	// reconnectDelay is how long to wait before reconnecting after a failure.
+	reconnectDelay = 5 * time.Second
+)
+
+// watchEvents calls handle for each event about the page being viewed.
+// It uses EventSource if it works, and otherwise falls back to WebSocket,
+// and then to long polling. EventSource may not work if a proxy buffers responses.
+func watchEvents(query url.Values, handle func(page.OutdatedEvent)) {
+	go func() {
+		if watchEventSource(query, handle) {
+			return
+		}
+		println("EventSource doesn't work, trying WebSocket")
+		if watchWebSocket(query, handle) {
+			return
+		}
+		println("WebSocket doesn't work, falling back to long polling")
+		watchLongPoll(query, handle)
+	}()
+}
+
+// watchEventSource receives events via EventSource. EventSource reconnects on its own,
+// so it returns true once the stream is working. It returns false if it doesn't work.
+func watchEventSource(query url.Values, handle func(page.OutdatedEvent)) bool {
+	ready := make(chan struct{}, 1)
+	u := url.URL{Path: "/-/events", RawQuery: query.Encode()}
+	source := eventsource.New(u.String())
+	source.AddEventListener("ready", false, func(*js.Object) {
+		select {
+		case ready <- struct{}{}:
+		default:
+		}
+	})
+	source.AddEventListener("message", false, func(event *js.Object) {
+		var outdated page.OutdatedEvent
+		err := json.Unmarshal([]byte(event.Get("data").String()), &outdated)
+		if err != nil {
+			println("failed to parse outdated event:", err.Error())
+			return
+		}
+		handle(outdated)
+	})
+
+	select {
+	case <-ready:
+		return true
+	case <-time.After(readyTimeout):
+		source.Close()
+		return false
+	}
+}
+
+// watchWebSocket receives events via WebSocket, reconnecting when the connection closes.
+// It returns false if WebSocket doesn't work. Otherwise, it never returns.
+func watchWebSocket(query url.Values, handle func(page.OutdatedEvent)) bool {
+	var lastID string
+	if !runWebSocket(query, &lastID, handle) {
+		return false
+	}
+	for {
+		time.Sleep(reconnectDelay)
+		runWebSocket(query, &lastID, handle)
+	}
+}
+
+// runWebSocket receives events over a single WebSocket connection, until it's closed.
+// lastID is the ID of the last event received, and it's updated as events arrive.
+// It reports whether the connection worked.
+func runWebSocket(query url.Values, lastID *string, handle func(page.OutdatedEvent)) (ok bool) {
+	u := url.URL{Scheme: "ws", Host: windowLocation.Host, Path: "/-/events/ws", RawQuery: withLastEventID(query, *lastID).Encode()}
+	if windowLocation.Scheme == "https" {
+		u.Scheme = "wss"
+	}
+	ws, err := websocketjs.New(u.String())
+	if err != nil {
+		println("failed to open WebSocket:", err.Error())
+		return false
+	}
+	messages := make(chan string, 100)
+	closed := make(chan struct{})
+	ws.AddEventListener("message", false, func(event *js.Object) {
+		select {
+		case messages <- event.Get("data").String():
+		default:
+		}
+	})
+	ws.AddEventListener("close", false, func(*js.Object) {
+		close(closed)
+	})
+
+	timeout := time.After(readyTimeout)
+	for {
+		select {
+		case data := <-messages:
+			ok, timeout = true, nil
+			var msg page.EventMessage
+			err := json.Unmarshal([]byte(data), &msg)
+			if err != nil {
+				println("failed to parse event message:", err.Error())
+				continue
+			}
+			receiveMessage(msg, lastID, handle)
+		case <-closed:
+			return ok
+		case <-timeout:
+			ws.Close()
+			return false
+		}
+	}
+}
+
+// watchLongPoll receives events via long polling. It never returns.
+func watchLongPoll(query url.Values, handle func(page.OutdatedEvent)) {
+	var lastID string
+	for {
+		msg, err := poll(withLastEventID(query, lastID))
+		if err != nil {
+			println("failed to poll for events:", err.Error())
+			time.Sleep(reconnectDelay)
+			continue
+		}
+		receiveMessage(msg, &lastID, handle)
+	}
+}
+
+func poll(query url.Values) (page.EventMessage, error) {
+	u := url.URL{Path: "/-/events/poll", RawQuery: query.Encode()}
+	resp, err := http.Get(u.String())
+	if err != nil {
+		return page.EventMessage{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return page.EventMessage{}, fmt.Errorf("non-200 status code: %v", resp.StatusCode)
+	}
+	var msg page.EventMessage
+	err = json.NewDecoder(resp.Body).Decode(&msg)
+	return msg, err
+}
+
+// receiveMessage updates lastID and handles the event in msg, if any.
+func receiveMessage(msg page.EventMessage, lastID *string, handle func(page.OutdatedEvent)) {
+	if msg.ID != "" {
+		*lastID = msg.ID
+	}
+	if msg.Event != nil {
+		handle(*msg.Event)
+	}
+}
+
+// withLastEventID returns a copy of query with LastEventID set to lastID, if it's non-empty.
+func withLastEventID(query url.Values, lastID string) url.Values {
+	q := make(url.Values, len(query)+1)
+	for k, v := range query {
+		q[k] = v
+	}
+	if lastID != "" {
+		q.Set("LastEventID", lastID)
+	}
+	return q
+}
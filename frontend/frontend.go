@@ -1,3 +1,4 @@
+//go:build js
 // +build js
 
 package main
@@ -5,11 +6,11 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
 
-	"github.com/gopherjs/eventsource"
 	"github.com/gopherjs/gopherjs/js"
 	_ "github.com/shurcooL/frontend/checkbox"
 	_ "github.com/shurcooL/frontend/select_menu"
@@ -50,7 +51,9 @@ func (s selection) Hash() string {
 func main() {
 	js.Global.Set("MustScrollTo", jsutil.Wrap(MustScrollTo))
 	js.Global.Set("LineNumber", jsutil.Wrap(LineNumber))
+	js.Global.Set("ToggleFold", jsutil.Wrap(ToggleFold))
 	js.Global.Set("HideOutdatedBox", HideOutdatedBox)
+	js.Global.Set("CheckForUpdates", CheckForUpdates)
 
 	switch readyState := document.ReadyState(); readyState {
 	case "loading":
@@ -69,24 +72,35 @@ func main() {
 		panic(err)
 	}
 
-	// EventSource updates.
+	// Live updates.
 	if state.RepoSpec.CloneURL != "" {
-		u := url.URL{
-			Path: "/-/events",
-			RawQuery: url.Values{
-				"ImportPath":        {state.ImportPath},
-				"Branch":            {state.ProcessedRev},
-				"RepoSpec.VCSType":  {state.RepoSpec.VCSType},
-				"RepoSpec.CloneURL": {state.RepoSpec.CloneURL},
-			}.Encode(),
+		query := url.Values{
+			"ImportPath":        {state.ImportPath},
+			"RepoImportPath":    {state.RepoImportPath},
+			"Branch":            {state.ProcessedRev},
+			"RepoSpec.VCSType":  {state.RepoSpec.VCSType},
+			"RepoSpec.CloneURL": {state.RepoSpec.CloneURL},
 		}
-
-		source := eventsource.New(u.String())
-		source.AddEventListener("message", false, func(event *js.Object) {
-			data := event.Get("data").String()
-			if data == "outdated" {
-				showOutdatedBox()
+		refreshQuery = url.Values{
+			"ImportPath":        {state.ImportPath},
+			"RepoSpec.VCSType":  {state.RepoSpec.VCSType},
+			"RepoSpec.CloneURL": {state.RepoSpec.CloneURL},
+		}
+		if e, ok := document.GetElementByID("check-for-updates").(dom.HTMLElement); ok {
+			e.Style().RemoveProperty("display")
+		}
+		watchEvents(query, func(outdated page.OutdatedEvent) {
+			if !liveMode() {
+				showOutdatedBox(outdated)
+				return
 			}
+			go func() {
+				err := refreshInPlace(outdated)
+				if err != nil {
+					println("failed to refresh in place:", err.Error())
+					showOutdatedBox(outdated)
+				}
+			}()
 		})
 	}
 }
@@ -201,7 +215,65 @@ func LineNumber(event dom.Event, targetId string) {
 	processHash(targetId, true)
 }
 
-func showOutdatedBox() {
+// ToggleFold folds or unfolds the fold with the given id.
+func ToggleFold(event dom.Event, id string) {
+	setFolded(id, !document.QuerySelector(`.fold-body[data-fold="`+id+`"]`).Class().Contains("folded"))
+
+	// Line positions have changed, so redraw the line selection.
+	drawSelection()
+}
+
+// setFolded folds the fold with the given id if folded is true, and unfolds it otherwise.
+func setFolded(id string, folded bool) {
+	for _, e := range document.QuerySelectorAll(`[data-fold="` + id + `"]`) {
+		if folded {
+			e.Class().Add("folded")
+		} else {
+			e.Class().Remove("folded")
+		}
+	}
+}
+
+// unfoldLine unfolds the fold that hides line number element e, if any.
+func unfoldLine(e dom.Element) {
+	if lines := e.Closest(".fold-lines.folded"); lines != nil {
+		setFolded(lines.GetAttribute("data-fold"), false)
+	}
+}
+
+// refreshQuery identifies the repository of the current page to /-/refresh.
+// It's nil if the repository can't be refreshed.
+var refreshQuery url.Values
+
+// CheckForUpdates asks the server to update the repository of the current page.
+// If there are new commits, the page is updated or marked as out of date
+// like for any other update.
+func CheckForUpdates() {
+	link := document.GetElementByID("check-for-updates").(dom.HTMLElement)
+	if refreshQuery == nil || !link.HasAttribute("href") {
+		return
+	}
+	link.RemoveAttribute("href")
+	link.SetTextContent("Checking for updates…")
+	go func() {
+		u := url.URL{Path: "/-/refresh", RawQuery: refreshQuery.Encode()}
+		resp, err := http.Post(u.String(), "", nil)
+		if err != nil {
+			println("failed to check for updates:", err.Error())
+			link.SetTextContent("Couldn't check for updates.")
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusAccepted {
+			println("failed to check for updates: non-202 status code:", resp.StatusCode)
+			link.SetTextContent("Couldn't check for updates.")
+			return
+		}
+	}()
+}
+
+func showOutdatedBox(event page.OutdatedEvent) {
+	document.GetElementByID("outdated-details").SetTextContent(event.Description())
 	document.GetElementByID("outdated-box").(dom.HTMLElement).Style().SetProperty("display", "block", "")
 }
 
@@ -228,36 +300,48 @@ func processHashSet() {
 	processHash(hash, ok)
 }
 
+// processHash selects the lines that hash points to, unfolding them if needed.
 // valid is true iff the hash points to a valid target.
 func processHash(hash string, valid bool) {
+	state.valid = valid
+	if valid {
+		state.file, state.start, state.end = parseHash(hash)
+	}
+	if state.valid && state.start != 0 {
+		// Selected lines must be visible.
+		unfoldLine(document.GetElementByID(fmt.Sprintf("%s-L%d", state.file, state.start)))
+		unfoldLine(document.GetElementByID(fmt.Sprintf("%s-L%d", state.file, state.end)))
+	}
+	drawSelection()
+}
+
+// drawSelection draws the selected lines. The selection is hidden
+// while its first or last line is folded.
+func drawSelection() {
 	// Clear everything.
 	for _, e := range document.GetElementsByClassName("selection") {
 		e.(dom.HTMLElement).Style().SetProperty("display", "none", "")
 	}
 
-	if !valid {
-		state.valid = false
+	if !state.valid || state.start == 0 {
 		return
 	}
-
-	file, start, end := parseHash(hash)
-	state.file, state.start, state.end, state.valid = file, start, end, true
-
-	if start != 0 {
-		startElement := document.GetElementByID(fmt.Sprintf("%s-L%d", file, start)).(dom.HTMLElement)
-		var endElement dom.HTMLElement
-		if end == start {
-			endElement = startElement
-		} else {
-			endElement = document.GetElementByID(fmt.Sprintf("%s-L%d", file, end)).(dom.HTMLElement)
-		}
-
-		fileHeader := document.GetElementByID(file).(dom.HTMLElement)
-		fileBackground := fileHeader.ParentElement().GetElementsByClassName("selection")[0].(dom.HTMLElement)
-		fileBackground.Style().SetProperty("display", "initial", "")
-		fileBackground.Style().SetProperty("top", fmt.Sprintf("%vpx", startElement.OffsetTop()), "")
-		fileBackground.Style().SetProperty("height", fmt.Sprintf("%vpx", endElement.OffsetTop()-startElement.OffsetTop()+endElement.OffsetHeight()), "")
+	startElement := document.GetElementByID(fmt.Sprintf("%s-L%d", state.file, state.start)).(dom.HTMLElement)
+	var endElement dom.HTMLElement
+	if state.end == state.start {
+		endElement = startElement
+	} else {
+		endElement = document.GetElementByID(fmt.Sprintf("%s-L%d", state.file, state.end)).(dom.HTMLElement)
 	}
+	if startElement.Closest(".fold-lines.folded") != nil || endElement.Closest(".fold-lines.folded") != nil {
+		return
+	}
+
+	fileHeader := document.GetElementByID(state.file).(dom.HTMLElement)
+	fileBackground := fileHeader.ParentElement().GetElementsByClassName("selection")[0].(dom.HTMLElement)
+	fileBackground.Style().SetProperty("display", "initial", "")
+	fileBackground.Style().SetProperty("top", fmt.Sprintf("%vpx", startElement.OffsetTop()), "")
+	fileBackground.Style().SetProperty("height", fmt.Sprintf("%vpx", endElement.OffsetTop()-startElement.OffsetTop()+endElement.OffsetHeight()), "")
 }
 
 func parseHash(hash string) (file string, start, end int) {
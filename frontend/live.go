@@ -0,0 +1,183 @@
+//go:build js
+// +build js
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/shurcooL/gtdo/gtdo"
+	"github.com/shurcooL/gtdo/page"
+	"honnef.co/go/js/dom"
+)
+
+// liveMode reports whether live updates are enabled for this page.
+func liveMode() bool {
+	_, live := windowLocation.Query()[gtdo.LiveQueryParameter]
+	return live && document.GetElementByID("files") != nil
+}
+
+// errFilesChanged is returned by refreshInPlace when the set of files
+// has changed, so the page can't be patched in place.
+var errFilesChanged = errors.New("set of files has changed")
+
+// refreshMu serializes in-place refreshes.
+var refreshMu sync.Mutex
+
+// refreshInPlace fetches the rendered files of the package at the new commit
+// and patches the changed ones into the page. It preserves scroll position
+// and line selection, and marks lines that are new or modified.
+//
+// It blocks, so it must be called from a goroutine.
+func refreshInPlace(event page.OutdatedEvent) error {
+	refreshMu.Lock()
+	defer refreshMu.Unlock()
+
+	u, err := url.Parse(dom.GetWindow().Location().Href)
+	if err != nil {
+		return err
+	}
+	query := u.Query()
+	query.Set(gtdo.FilesFragmentQueryParameter, "")
+	u.RawQuery, u.Fragment = query.Encode(), ""
+	resp, err := http.Get(u.String())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("non-200 status code: %v", resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	commitID := resp.Header.Get(gtdo.CommitIDHeader)
+	if commitID != event.NewCommitID {
+		// The branch has moved on again; a later event will follow.
+		return nil
+	}
+
+	newFiles := document.CreateElement("div")
+	newFiles.SetInnerHTML(string(body))
+	oldHeaders := fileHeaders(document.GetElementByID("files"))
+	newHeaders := fileHeaders(newFiles)
+	if len(oldHeaders) != len(newHeaders) {
+		return errFilesChanged
+	}
+	for i := range oldHeaders {
+		if oldHeaders[i].ID() != newHeaders[i].ID() {
+			return errFilesChanged
+		}
+	}
+
+	anchor, anchorTop := scrollAnchor()
+	for i, header := range oldHeaders {
+		oldHighlight := header.NextElementSibling()
+		newHighlight := newHeaders[i].NextElementSibling()
+		if !oldHighlight.Class().Contains("highlight") || !newHighlight.Class().Contains("highlight") {
+			// Rendered files, like Markdown, don't have lines to mark.
+			if oldHighlight.OuterHTML() != newHighlight.OuterHTML() {
+				oldHighlight.ParentNode().ReplaceChild(newHighlight, oldHighlight)
+			}
+			continue
+		}
+		oldLines := strings.Split(oldHighlight.QuerySelector("pre.file").TextContent(), "\n")
+		newLines := strings.Split(newHighlight.QuerySelector("pre.file").TextContent(), "\n")
+		if equalLines(oldLines, newLines) {
+			continue
+		}
+		var folded []string
+		for _, e := range oldHighlight.QuerySelectorAll(".fold-body.folded") {
+			folded = append(folded, e.GetAttribute("data-fold"))
+		}
+		oldHighlight.ParentNode().ReplaceChild(newHighlight, oldHighlight)
+		for _, id := range folded {
+			// Folds that still exist stay folded.
+			setFolded(id, true)
+		}
+		if build := newHeaders[i].GetAttribute("data-build"); build != "" {
+			header.SetAttribute("data-build", build)
+		} else {
+			header.RemoveAttribute("data-build")
+		}
+		markChangedLines(header.ID(), oldLines, newLines)
+	}
+	if anchor != "" {
+		// Keep the line that was at the top of the window in the same place.
+		if e, ok := document.GetElementByID(anchor).(dom.HTMLElement); ok {
+			dom.GetWindow().ScrollTo(dom.GetWindow().ScrollX(), dom.GetWindow().ScrollY()+int(e.GetBoundingClientRect().Top-anchorTop))
+		}
+	}
+
+	// Update commit ID, so that 'y' gives a permalink to the code being displayed.
+	if commitIdEl := document.GetElementByID("commit-id"); commitIdEl != nil {
+		commitIdEl.SetAttribute("title", commitID)
+		short := commitID
+		if len(short) > 8 {
+			short = short[:8]
+		}
+		commitIdEl.QuerySelector("code").SetTextContent(short)
+	}
+
+	// Redraw line selection, unless the selected lines no longer exist.
+	// Folds are kept as they are, even if they hide selected lines.
+	if state.valid && state.end != 0 && document.GetElementByID(fmt.Sprintf("%s-L%d", state.file, state.end)) == nil {
+		state.valid = false
+	}
+	drawSelection()
+
+	return nil
+}
+
+// scrollAnchor returns the ID of the first line number visible in the window,
+// and its offset from the top of the window. It returns "" if there isn't one.
+func scrollAnchor() (id string, top float64) {
+	for _, e := range document.GetElementByID("files").QuerySelectorAll("span.ln") {
+		if top := e.GetBoundingClientRect().Top; top >= 0 {
+			return e.ID(), top
+		}
+	}
+	return "", 0
+}
+
+// markChangedLines marks line numbers of file lines that aren't present in oldLines.
+func markChangedLines(file string, oldLines, newLines []string) {
+	old := make(map[string]int) // Line -> number of occurrences.
+	for _, line := range oldLines {
+		old[line]++
+	}
+	for i, line := range newLines {
+		if old[line] > 0 {
+			old[line]--
+			continue
+		}
+		if ln := document.GetElementByID(fmt.Sprintf("%s-L%d", file, i+1)); ln != nil {
+			ln.Class().Add("changed")
+		}
+	}
+}
+
+// fileHeaders returns the headers of file sections in files,
+// leaving out headers within rendered files.
+func fileHeaders(files dom.Element) []dom.Element {
+	return files.QuerySelectorAll(":scope > div > h2")
+}
+
+func equalLines(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -280,6 +280,9 @@ func updateResults(init bool, overlay dom.HTMLElement) {
 
 		element := document.CreateElement("div")
 		element.Class().Add("gts-entry")
+		if header.Class().Contains("deprecated") {
+			element.Class().Add("gts-deprecated")
+		}
 		element.SetAttribute("data-id", header.ID())
 		{
 			entry := header.TextContent()
@@ -1,9 +1,12 @@
+//go:build js
 // +build js
 
 // Package tableofcontents provides a table of contents component.
 package tableofcontents
 
 import (
+	"strings"
+
 	"github.com/gopherjs/gopherjs/js"
 	"github.com/shurcooL/gtdo/internal/sanitizedanchorname"
 	"honnef.co/go/js/dom"
@@ -13,13 +16,15 @@ var document = dom.GetWindow().Document().(dom.HTMLDocument)
 
 var (
 	headers []dom.Element
+	entries []dom.Element // Entries of headers.
 	results *dom.HTMLDivElement
 )
 
 // Setup sets up the table of contents component on the current page.
 // It must be called exactly once after document body has finished loading.
 func Setup() {
-	headers = document.Body().GetElementsByTagName("h2")
+	// Headers of files, package docs and READMEs, leaving out headers within rendered files.
+	headers = document.QuerySelectorAll("#files > div > h2, .doc-summary > h2, .readme > h2")
 	if len(headers) == 0 {
 		return
 	}
@@ -35,7 +40,10 @@ func Setup() {
 		element.Class().Add("toc-entry")
 		element.SetTextContent(header.TextContent())
 
-		href := "#" + sanitizedanchorname.Create(header.TextContent())
+		href := "#" + header.ID()
+		if header.ID() == "" {
+			href = "#" + sanitizedanchorname.Create(header.TextContent())
+		}
 		target := header.(dom.HTMLElement)
 		element.AddEventListener("click", false, func(event dom.Event) {
 			//dom.GetWindow().History().ReplaceState(nil, nil, href)
@@ -46,6 +54,11 @@ func Setup() {
 		})
 
 		results.AppendChild(element)
+		entries = append(entries, element)
+
+		if outline := fileOutline(header); outline != nil {
+			results.AppendChild(outline)
+		}
 	}
 
 	overlay.AppendChild(results)
@@ -60,8 +73,8 @@ func Setup() {
 
 func updateTOC() {
 	// Clear all past highlighted.
-	for _, node := range results.ChildNodes() {
-		node.(dom.Element).Class().Remove("toc-highlighted")
+	for _, entry := range entries {
+		entry.Class().Remove("toc-highlighted")
 	}
 
 	// Highlight one entry.
@@ -69,8 +82,122 @@ func updateTOC() {
 	for i := len(headers) - 1; i >= 0; i-- {
 		header := headers[i]
 		if int(header.GetBoundingClientRect().Top) <= windowHalfHeight || i == 0 {
-			results.ChildNodes()[i].(dom.Element).Class().Add("toc-highlighted")
+			entries[i].Class().Add("toc-highlighted")
 			break
 		}
 	}
 }
+
+// fileOutline returns an outline of the declarations in the file section of header,
+// or nil if it has none. Types are listed with their methods, followed by
+// functions, constants and variables. The outline is displayed while the
+// entry of header is highlighted.
+func fileOutline(header dom.Element) dom.Element {
+	source := header.NextElementSibling()
+	if source == nil {
+		return nil
+	}
+	decls := source.QuerySelectorAll("h3[data-kind]")
+	if len(decls) == 0 {
+		return nil
+	}
+
+	var (
+		types   []string
+		recvs   []string                    // Receiver types, in order of their first method.
+		methods = make(map[string][]string) // Receiver type -> method IDs.
+		kinds   = make(map[string][]string) // Kind -> declaration IDs.
+	)
+	for _, decl := range decls {
+		id := decl.ID()
+		switch kind := decl.GetAttribute("data-kind"); kind {
+		case "type":
+			types = append(types, id)
+		case "method":
+			recv := id[:strings.LastIndex(id, ".")]
+			if i := strings.Index(recv, "["); i != -1 {
+				recv = recv[:i] // Leave out type parameters.
+			}
+			if _, ok := methods[recv]; !ok {
+				recvs = append(recvs, recv)
+			}
+			methods[recv] = append(methods[recv], id)
+		default:
+			kinds[kind] = append(kinds[kind], id)
+		}
+	}
+	for _, recv := range recvs {
+		if !contains(types, recv) {
+			// Methods of a type declared in another file.
+			types = append(types, recv)
+		}
+	}
+
+	outline := document.CreateElement("div")
+	outline.Class().Add("toc-outline")
+	if len(types) != 0 {
+		outline.AppendChild(outlineLabel("Types"))
+		for _, typ := range types {
+			outline.AppendChild(outlineEntry(typ, typ, "toc-type"))
+			for _, method := range methods[typ] {
+				outline.AppendChild(outlineEntry(method[strings.LastIndex(method, ".")+1:], method, "toc-method"))
+			}
+		}
+	}
+	for _, k := range []struct{ kind, label string }{
+		{"func", "Functions"},
+		{"const", "Constants"},
+		{"var", "Variables"},
+	} {
+		if len(kinds[k.kind]) == 0 {
+			continue
+		}
+		outline.AppendChild(outlineLabel(k.label))
+		for _, id := range kinds[k.kind] {
+			outline.AppendChild(outlineEntry(id, id, "toc-decl"))
+		}
+	}
+	return outline
+}
+
+func outlineLabel(text string) dom.Element {
+	label := document.CreateElement("div")
+	label.Class().Add("toc-label")
+	label.SetTextContent(text)
+	return label
+}
+
+// outlineEntry returns an outline entry with text that scrolls to the element with the given id.
+// The element is looked up when clicked, since live updates may replace it.
+func outlineEntry(text, id, class string) dom.Element {
+	element := document.CreateElement("div")
+	element.Class().Add("toc-entry")
+	element.Class().Add(class)
+	element.SetTextContent(text)
+	element.AddEventListener("click", false, func(event dom.Event) {
+		target, ok := document.GetElementByID(id).(dom.HTMLElement)
+		if !ok {
+			return
+		}
+
+		//dom.GetWindow().History().ReplaceState(nil, nil, "#"+id)
+		js.Global.Get("window").Get("history").Call("replaceState", nil, nil, "#"+id)
+
+		var offsetTop float64
+		for e := target; e != nil; e = e.OffsetParent() {
+			offsetTop += e.OffsetTop()
+		}
+		windowHalfHeight := dom.GetWindow().InnerHeight() * 2 / 5
+		dom.GetWindow().ScrollTo(dom.GetWindow().ScrollX(), int(offsetTop+target.OffsetHeight())-windowHalfHeight)
+	})
+	return element
+}
+
+func contains(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
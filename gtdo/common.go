@@ -3,3 +3,37 @@ package gtdo
 
 // RevisionQueryParameter is the query parameter name used for specifying vcs revisions.
 const RevisionQueryParameter = "rev"
+
+// LiveQueryParameter is the query parameter name used for enabling live updates,
+// where the code of a package is refreshed in place when it changes.
+const LiveQueryParameter = "live"
+
+// FilesFragmentQueryParameter is the query parameter name used for requesting
+// only the rendered files of a package, rather than a full page.
+const FilesFragmentQueryParameter = "files-fragment"
+
+// CommitIDHeader is the response header that holds the commit ID of a files fragment.
+const CommitIDHeader = "Gtdo-Commit-Id"
+
+// BaseQueryParameter is the query parameter name used for specifying the vcs revision
+// that the API of a package is compared against.
+const BaseQueryParameter = "base"
+
+// GOOSQueryParameter and GOARCHQueryParameter are the query parameter names used for
+// specifying the target operating system and architecture that packages are resolved for.
+const (
+	GOOSQueryParameter   = "goos"
+	GOARCHQueryParameter = "goarch"
+)
+
+// CgoQueryParameter is the query parameter name used for toggling cgo
+// from its default setting when resolving packages.
+const CgoQueryParameter = "cgo"
+
+// TagsQueryParameter is the query parameter name used for specifying
+// comma-separated build tags that packages are resolved with.
+const TagsQueryParameter = "tags"
+
+// RawQueryParameter is the query parameter name used for requesting the raw contents
+// of a file in a package directory, rather than a page.
+const RawQueryParameter = "raw"
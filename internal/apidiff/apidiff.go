@@ -0,0 +1,492 @@
+// Package apidiff reports differences in the exported API of a Go package
+// between two versions, and whether they are compatible.
+package apidiff
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Importer type-checks packages for comparison.
+//
+// Imports are loaded with Load. Packages that can't be loaded, such as ones
+// outside of the repository being viewed, are replaced with placeholders
+// that declare an opaque named type for each name referenced from them.
+// That's enough for declarations that use them to be compared by name.
+type Importer struct {
+	Fset *token.FileSet
+
+	// Load returns the parsed non-test Go files of the package with importPath.
+	// It returns an error if the package isn't available.
+	Load func(importPath string) ([]*ast.File, error)
+
+	packages map[string]*types.Package  // Checked packages by import path, nil while being checked.
+	refs     map[string]map[string]bool // Names referenced from imported packages, by import path. True if not only called.
+}
+
+// Import implements types.Importer.
+func (imp *Importer) Import(path string) (*types.Package, error) {
+	if path == "unsafe" {
+		return types.Unsafe, nil
+	}
+	imp.init()
+	if pkg, ok := imp.packages[path]; ok {
+		if pkg == nil {
+			// Import cycle. It's an error in the package, so don't bother.
+			return imp.placeholder(path), nil
+		}
+		return pkg, nil
+	}
+	if imp.Load == nil {
+		return imp.placeholder(path), nil
+	}
+	imp.packages[path] = nil
+	files, err := imp.Load(path)
+	if err != nil {
+		delete(imp.packages, path)
+		return imp.placeholder(path), nil
+	}
+	pkg := imp.Check(path, files)
+	imp.packages[path] = pkg
+	return pkg, nil
+}
+
+// Check type-checks the package with import path made of files.
+// Errors are ignored, so the result is always a package,
+// but the types of erroneous declarations may be invalid.
+func (imp *Importer) Check(path string, files []*ast.File) *types.Package {
+	imp.init()
+	imp.collectRefs(files)
+	conf := types.Config{
+		Importer:         imp,
+		FakeImportC:      true,
+		IgnoreFuncBodies: true,
+		Error:            func(error) {},
+	}
+	pkg, _ := conf.Check(path, imp.Fset, files, nil)
+	return pkg
+}
+
+func (imp *Importer) init() {
+	if imp.packages == nil {
+		imp.packages = make(map[string]*types.Package)
+		imp.refs = make(map[string]map[string]bool)
+	}
+}
+
+// collectRefs records names of imported packages that are referenced from files.
+func (imp *Importer) collectRefs(files []*ast.File) {
+	for _, f := range files {
+		imports := make(map[string]string) // Local name -> import path.
+		for _, spec := range f.Imports {
+			path, err := strconv.Unquote(spec.Path.Value)
+			if err != nil {
+				continue
+			}
+			name := packageName(path)
+			if spec.Name != nil {
+				name = spec.Name.Name
+			}
+			imports[name] = path
+		}
+		called := make(map[*ast.SelectorExpr]bool)
+		ast.Inspect(f, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.CallExpr:
+				if sel, ok := n.Fun.(*ast.SelectorExpr); ok {
+					called[sel] = true
+				}
+			case *ast.SelectorExpr:
+				x, ok := n.X.(*ast.Ident)
+				if !ok || x.Obj != nil {
+					return true
+				}
+				path, ok := imports[x.Name]
+				if !ok {
+					return true
+				}
+				if imp.refs[path] == nil {
+					imp.refs[path] = make(map[string]bool)
+				}
+				imp.refs[path][n.Sel.Name] = imp.refs[path][n.Sel.Name] || !called[n]
+			}
+			return true
+		})
+	}
+}
+
+// placeholder returns a package with import path that declares
+// an opaque named type for each name referenced from it so far.
+// Names that are only ever called are declared as functions instead,
+// so that variables initialized by calling them aren't given their type.
+func (imp *Importer) placeholder(path string) *types.Package {
+	pkg := types.NewPackage(path, packageName(path))
+	for name, notOnlyCalled := range imp.refs[path] {
+		if !notOnlyCalled {
+			params := types.NewTuple(types.NewVar(token.NoPos, pkg, "", types.NewSlice(types.NewInterfaceType(nil, nil).Complete())))
+			pkg.Scope().Insert(types.NewFunc(token.NoPos, pkg, name, types.NewSignature(nil, params, nil, true)))
+			continue
+		}
+		obj := types.NewTypeName(token.NoPos, pkg, name, nil)
+		types.NewNamed(obj, types.NewInterfaceType(nil, nil).Complete(), nil)
+		pkg.Scope().Insert(obj)
+	}
+	pkg.MarkComplete()
+	return pkg
+}
+
+// packageName guesses the name of the package with import path,
+// using the same conventions as goimports.
+func packageName(path string) string {
+	elems := strings.Split(path, "/")
+	name := elems[len(elems)-1]
+	if len(elems) > 1 && isMajorVersion(name) {
+		name = elems[len(elems)-2]
+	}
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		name = name[:i] // E.g., "gopkg.in/yaml.v2".
+	}
+	name = strings.TrimPrefix(name, "go-")
+	return strings.Map(func(r rune) rune {
+		if r == '_' || 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// isMajorVersion reports whether elem is a major version suffix, like "v2".
+func isMajorVersion(elem string) bool {
+	if len(elem) < 2 || elem[0] != 'v' {
+		return false
+	}
+	_, err := strconv.ParseUint(elem[1:], 10, 32)
+	return err == nil
+}
+
+// Kind is the kind of a change.
+type Kind int
+
+const (
+	Added Kind = iota
+	Removed
+	Changed
+)
+
+func (k Kind) String() string {
+	switch k {
+	case Added:
+		return "added"
+	case Removed:
+		return "removed"
+	case Changed:
+		return "changed"
+	default:
+		return fmt.Sprintf("Kind(%d)", int(k))
+	}
+}
+
+// Change is a difference in the exported API of a package.
+type Change struct {
+	Name         string // E.g., "F", "T", "T.Method" or "T.Field".
+	Kind         Kind
+	Old, New     string // Declarations before and after the change, empty if added or removed.
+	Incompatible bool   // Whether the change can break existing users of the package.
+}
+
+// Diff returns the changes in the exported API from package old to package new,
+// sorted by name.
+func Diff(old, new *types.Package) []Change {
+	d := differ{
+		oldQ: qualifier(old),
+		newQ: qualifier(new),
+	}
+	for _, name := range union(exportedNames(old.Scope()), exportedNames(new.Scope())) {
+		o, n := old.Scope().Lookup(name), new.Scope().Lookup(name)
+		switch {
+		case o == nil:
+			d.add(Change{Name: name, Kind: Added, New: d.objString(n, d.newQ)})
+		case n == nil:
+			d.add(Change{Name: name, Kind: Removed, Old: d.objString(o, d.oldQ), Incompatible: true})
+		default:
+			d.object(name, o, n)
+		}
+	}
+	return d.changes
+}
+
+type differ struct {
+	oldQ, newQ types.Qualifier
+	changes    []Change
+}
+
+func (d *differ) add(c Change) { d.changes = append(d.changes, c) }
+
+// changed records an incompatible change of name from o to n, unless they're equal.
+// It reports whether there was a change.
+func (d *differ) changed(name, o, n string) bool {
+	if o == n {
+		return false
+	}
+	d.add(Change{Name: name, Kind: Changed, Old: o, New: n, Incompatible: true})
+	return true
+}
+
+func (d *differ) object(name string, o, n types.Object) {
+	if d.changed(name, objKind(o)+" "+name, objKind(n)+" "+name) {
+		return
+	}
+	switch o := o.(type) {
+	case *types.Const, *types.Var, *types.Func:
+		d.changed(name, d.objString(o, d.oldQ), d.objString(n, d.newQ))
+	case *types.TypeName:
+		d.typeName(name, o, n.(*types.TypeName))
+	}
+}
+
+func (d *differ) typeName(name string, o, n *types.TypeName) {
+	if d.changed(name, d.objString(o, d.oldQ), d.objString(n, d.newQ)) || o.IsAlias() {
+		return
+	}
+	on, ok1 := o.Type().(*types.Named)
+	nn, ok2 := n.Type().(*types.Named)
+	if !ok1 || !ok2 {
+		return
+	}
+	switch ou := on.Underlying().(type) {
+	case *types.Struct:
+		d.fields(name, ou, nn.Underlying().(*types.Struct))
+	case *types.Interface:
+		d.interfaceMethods(name, ou, nn.Underlying().(*types.Interface))
+		return
+	}
+	d.methods(name, on, nn)
+}
+
+// fields compares exported fields of structs o and n of type named typeName.
+func (d *differ) fields(typeName string, o, n *types.Struct) {
+	of, nf := exportedFields(o), exportedFields(n)
+	for _, name := range union(keys(of), keys(nf)) {
+		qualified := typeName + "." + name
+		switch o, n := of[name], nf[name]; {
+		case o == nil:
+			d.add(Change{Name: qualified, Kind: Added, New: fieldString(n, d.newQ)})
+		case n == nil:
+			d.add(Change{Name: qualified, Kind: Removed, Old: fieldString(o, d.oldQ), Incompatible: true})
+		default:
+			d.changed(qualified, fieldString(o, d.oldQ), fieldString(n, d.newQ))
+		}
+	}
+}
+
+// interfaceMethods compares methods of interfaces o and n of type named typeName.
+// Any added method is incompatible, since existing implementations don't have it,
+// unless the interface already had unexported methods and can't be implemented elsewhere.
+func (d *differ) interfaceMethods(typeName string, o, n *types.Interface) {
+	om, nm := make(map[string]*types.Func), make(map[string]*types.Func)
+	sealed := false
+	for i := 0; i < o.NumMethods(); i++ {
+		if m := o.Method(i); m.Exported() {
+			om[m.Name()] = m
+		} else {
+			sealed = true
+		}
+	}
+	for i := 0; i < n.NumMethods(); i++ {
+		if m := n.Method(i); m.Exported() {
+			nm[m.Name()] = m
+		}
+	}
+	for _, name := range union(keys(om), keys(nm)) {
+		qualified := typeName + "." + name
+		switch o, n := om[name], nm[name]; {
+		case o == nil:
+			d.add(Change{Name: qualified, Kind: Added, New: name + signatureString(n, d.newQ), Incompatible: !sealed})
+		case n == nil:
+			d.add(Change{Name: qualified, Kind: Removed, Old: name + signatureString(o, d.oldQ), Incompatible: true})
+		default:
+			d.changed(qualified, name+signatureString(o, d.oldQ), name+signatureString(n, d.newQ))
+		}
+	}
+}
+
+// methods compares exported methods of named types o and n, including promoted ones.
+// Moving a method from a value to a pointer receiver is incompatible,
+// since values of the type no longer have it, but the opposite is fine.
+func (d *differ) methods(typeName string, o, n *types.Named) {
+	om, nm := methodSet(o), methodSet(n)
+	for _, name := range union(keys(om), keys(nm)) {
+		qualified := typeName + "." + name
+		switch o, n := om[name], nm[name]; {
+		case o == nil:
+			d.add(Change{Name: qualified, Kind: Added, New: n.String(typeName, d.newQ)})
+		case n == nil:
+			d.add(Change{Name: qualified, Kind: Removed, Old: o.String(typeName, d.oldQ), Incompatible: true})
+		default:
+			os, ns := o.String(typeName, d.oldQ), n.String(typeName, d.newQ)
+			if os == ns {
+				continue
+			}
+			incompatible := signatureString(o.fn, d.oldQ) != signatureString(n.fn, d.newQ) || !o.pointer && n.pointer
+			d.add(Change{Name: qualified, Kind: Changed, Old: os, New: ns, Incompatible: incompatible})
+		}
+	}
+}
+
+type method struct {
+	fn      *types.Func
+	pointer bool // Whether the method is only in the method set of the pointer type.
+}
+
+func (m *method) String(typeName string, q types.Qualifier) string {
+	recv := typeName
+	if m.pointer {
+		recv = "*" + typeName
+	}
+	return "func (" + recv + ") " + m.fn.Name() + signatureString(m.fn, q)
+}
+
+func methodSet(t *types.Named) map[string]*method {
+	values := types.NewMethodSet(t)
+	pointers := types.NewMethodSet(types.NewPointer(t))
+	ms := make(map[string]*method)
+	for i := 0; i < pointers.Len(); i++ {
+		fn, ok := pointers.At(i).Obj().(*types.Func)
+		if !ok || !fn.Exported() {
+			continue
+		}
+		ms[fn.Name()] = &method{fn: fn, pointer: values.Lookup(nil, fn.Name()) == nil}
+	}
+	return ms
+}
+
+func exportedFields(s *types.Struct) map[string]*types.Var {
+	fs := make(map[string]*types.Var)
+	for i := 0; i < s.NumFields(); i++ {
+		if f := s.Field(i); f.Exported() {
+			fs[f.Name()] = f
+		}
+	}
+	return fs
+}
+
+func fieldString(f *types.Var, q types.Qualifier) string {
+	if f.Embedded() {
+		return types.TypeString(f.Type(), q)
+	}
+	return f.Name() + " " + types.TypeString(f.Type(), q)
+}
+
+func signatureString(fn *types.Func, q types.Qualifier) string {
+	var buf bytes.Buffer
+	types.WriteSignature(&buf, fn.Type().(*types.Signature), q)
+	return buf.String()
+}
+
+// objString returns the declaration of obj. Struct and interface types
+// are abbreviated, since their fields and methods are compared separately.
+func (d *differ) objString(obj types.Object, q types.Qualifier) string {
+	switch obj := obj.(type) {
+	case *types.Const:
+		return "const " + obj.Name() + " " + types.TypeString(obj.Type(), q) + " = " + obj.Val().String()
+	case *types.Var:
+		if obj.Type() == types.Typ[types.Invalid] {
+			return "var " + obj.Name() // Its type depends on a placeholder.
+		}
+		return "var " + obj.Name() + " " + types.TypeString(obj.Type(), q)
+	case *types.Func:
+		return "func " + obj.Name() + signatureString(obj, q)
+	case *types.TypeName:
+		if obj.IsAlias() {
+			return "type " + obj.Name() + " = " + types.TypeString(obj.Type(), q)
+		}
+		s := "type " + obj.Name()
+		named, ok := obj.Type().(*types.Named)
+		if !ok {
+			return s + " " + types.TypeString(obj.Type().Underlying(), q)
+		}
+		if tparams := named.TypeParams(); tparams.Len() > 0 {
+			var ps []string
+			for i := 0; i < tparams.Len(); i++ {
+				p := tparams.At(i)
+				ps = append(ps, p.Obj().Name()+" "+types.TypeString(p.Constraint(), q))
+			}
+			s += "[" + strings.Join(ps, ", ") + "]"
+		}
+		switch u := named.Underlying().(type) {
+		case *types.Struct:
+			return s + " struct"
+		case *types.Interface:
+			return s + " interface"
+		default:
+			return s + " " + types.TypeString(u, q)
+		}
+	default:
+		return obj.String()
+	}
+}
+
+func objKind(obj types.Object) string {
+	switch obj.(type) {
+	case *types.Const:
+		return "const"
+	case *types.Var:
+		return "var"
+	case *types.Func:
+		return "func"
+	case *types.TypeName:
+		return "type"
+	default:
+		return "object"
+	}
+}
+
+// qualifier returns a types.Qualifier that omits package pkg,
+// and refers to other packages by name. pkg is compared by path,
+// so that types in the old and new versions print the same way.
+func qualifier(pkg *types.Package) types.Qualifier {
+	return func(other *types.Package) string {
+		if other.Path() == pkg.Path() {
+			return ""
+		}
+		return other.Name()
+	}
+}
+
+func exportedNames(scope *types.Scope) []string {
+	var names []string
+	for _, name := range scope.Names() {
+		if token.IsExported(name) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func keys[V any](m map[string]V) []string {
+	ks := make([]string, 0, len(m))
+	for k := range m {
+		ks = append(ks, k)
+	}
+	return ks
+}
+
+// union returns the sorted union of a and b.
+func union(a, b []string) []string {
+	set := make(map[string]bool, len(a)+len(b))
+	for _, s := range a {
+		set[s] = true
+	}
+	for _, s := range b {
+		set[s] = true
+	}
+	ks := keys(set)
+	sort.Strings(ks)
+	return ks
+}
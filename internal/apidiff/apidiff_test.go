@@ -0,0 +1,216 @@
+package apidiff
+
+import (
+	"errors"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"reflect"
+	"testing"
+)
+
+func check(t *testing.T, src string, deps map[string]string) *types.Package {
+	t.Helper()
+	fset := token.NewFileSet()
+	parse := func(src string) *ast.File {
+		f, err := parser.ParseFile(fset, "p.go", src, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+	imp := &Importer{
+		Fset: fset,
+		Load: func(importPath string) ([]*ast.File, error) {
+			src, ok := deps[importPath]
+			if !ok {
+				return nil, errors.New("not found")
+			}
+			return []*ast.File{parse(src)}, nil
+		},
+	}
+	return imp.Check("example.com/p", []*ast.File{parse(src)})
+}
+
+func TestDiff(t *testing.T) {
+	old := check(t, `package p
+
+import "io"
+
+const C = 1
+
+var V int
+
+func F(r io.Reader) error { return nil }
+func Removed() {}
+
+type S struct {
+	A int
+	B string
+	c bool
+}
+
+func (S) M()       {}
+func (*S) Ptr()    {}
+func (S) ToPtr()   {}
+func (*S) ToValue() {}
+
+type I interface {
+	M()
+}
+
+type Sealed interface {
+	M()
+	sealed()
+}
+
+type T int
+`, nil)
+	new := check(t, `package p
+
+import (
+	"io"
+	"strings"
+)
+
+const C = 2
+
+var V int64
+
+func F(r io.Reader) error { return nil }
+func Added(b *strings.Builder) {}
+
+type S struct {
+	A int
+	B []byte
+	D float64
+}
+
+func (S) M()       {}
+func (*S) Ptr()    {}
+func (*S) ToPtr()  {}
+func (S) ToValue() {}
+
+type I interface {
+	M()
+	N()
+}
+
+type Sealed interface {
+	M()
+	N()
+	sealed()
+}
+
+type T string
+`, nil)
+
+	got := Diff(old, new)
+	want := []Change{
+		{Name: "Added", Kind: Added, New: "func Added(b *strings.Builder)"},
+		{Name: "C", Kind: Changed, Old: "const C untyped int = 1", New: "const C untyped int = 2", Incompatible: true},
+		{Name: "I.N", Kind: Added, New: "N()", Incompatible: true},
+		{Name: "Removed", Kind: Removed, Old: "func Removed()", Incompatible: true},
+		{Name: "S.B", Kind: Changed, Old: "B string", New: "B []byte", Incompatible: true},
+		{Name: "S.D", Kind: Added, New: "D float64"},
+		{Name: "S.ToPtr", Kind: Changed, Old: "func (S) ToPtr()", New: "func (*S) ToPtr()", Incompatible: true},
+		{Name: "S.ToValue", Kind: Changed, Old: "func (*S) ToValue()", New: "func (S) ToValue()"},
+		{Name: "Sealed.N", Kind: Added, New: "N()"},
+		{Name: "T", Kind: Changed, Old: "type T int", New: "type T string", Incompatible: true},
+		{Name: "V", Kind: Changed, Old: "var V int", New: "var V int64", Incompatible: true},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got:\n%v\nwant:\n%v", got, want)
+	}
+}
+
+func TestDiffImports(t *testing.T) {
+	deps := map[string]string{
+		"example.com/q": `package q
+
+import "io"
+
+type R struct{ io.Reader }
+`,
+	}
+	old := check(t, `package p
+
+import (
+	"errors"
+
+	"example.com/q"
+	yaml "gopkg.in/yaml.v2"
+)
+
+var ErrRemoved = errors.New("removed")
+
+func F(q.R, yaml.Node) {}
+`, deps)
+	new := check(t, `package p
+
+import (
+	"example.com/q"
+	yaml "gopkg.in/yaml.v2"
+)
+
+func F(*q.R, yaml.Node) {}
+`, deps)
+
+	got := Diff(old, new)
+	want := []Change{
+		{Name: "ErrRemoved", Kind: Removed, Old: "var ErrRemoved", Incompatible: true},
+		{Name: "F", Kind: Changed, Old: "func F(q.R, yaml.Node)", New: "func F(*q.R, yaml.Node)", Incompatible: true},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got:\n%v\nwant:\n%v", got, want)
+	}
+}
+
+func TestCheckVersions(t *testing.T) {
+	added := []Change{{Name: "F", Kind: Added}}
+	removed := []Change{{Name: "F", Kind: Removed, Incompatible: true}}
+	tests := []struct {
+		old, new      string
+		changes       []Change
+		wantViolation bool
+		wantErr       bool
+	}{
+		{"v1.0.0", "v1.0.1", nil, false, false},
+		{"v1.0.0", "v1.0.1", added, true, false},
+		{"v1.0.0", "v1.1.0", added, false, false},
+		{"v1.0.0", "v1.1.0", removed, true, false},
+		{"v1.5.0", "v2.0.0", removed, false, false},
+		{"v0.1.0", "v0.1.1", removed, false, false},
+		{"v1.0.0-rc.1", "v1.0.0", nil, false, false},
+		{"v1.0.0", "v1.0.0", nil, false, true},
+		{"v1.1.0", "v1.0.0", nil, false, true},
+		{"v1.0", "v1.0.1", nil, false, true},
+		{"master", "v1.0.1", nil, false, true},
+	}
+	for _, tt := range tests {
+		violation, _, err := CheckVersions(tt.old, tt.new, tt.changes)
+		if gotErr := err != nil; gotErr != tt.wantErr {
+			t.Errorf("CheckVersions(%q, %q): got error %v, want error %v", tt.old, tt.new, err, tt.wantErr)
+			continue
+		}
+		if violation != tt.wantViolation {
+			t.Errorf("CheckVersions(%q, %q, %v): got violation %v, want %v", tt.old, tt.new, tt.changes, violation, tt.wantViolation)
+		}
+	}
+}
+
+func TestVersion(t *testing.T) {
+	for tag, want := range map[string]string{
+		"v1.2.3":          "v1.2.3",
+		"sub/dir/v0.1.0":  "v0.1.0",
+		"v1.2.3-pre+meta": "v1.2.3-pre+meta",
+		"go1.21.0":        "",
+		"master":          "",
+		"v01.2.3":         "",
+	} {
+		if got := Version(tag); got != want {
+			t.Errorf("Version(%q): got %q, want %q", tag, got, want)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package apidiff
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Version returns the semantic version in tag, or "" if it's not a version tag.
+// Tags of modules in subdirectories, like "sub/v1.2.3", are supported.
+func Version(tag string) string {
+	v := tag[strings.LastIndex(tag, "/")+1:]
+	if _, ok := parseVersion(v); !ok {
+		return ""
+	}
+	return v
+}
+
+// CheckVersions checks changes between module versions oldVersion and newVersion
+// against semantic versioning. It reports whether the changes violate it,
+// along with an explanation. It returns an error if a version isn't valid,
+// or if newVersion isn't newer than oldVersion.
+func CheckVersions(oldVersion, newVersion string, changes []Change) (violation bool, explanation string, err error) {
+	o, ok := parseVersion(oldVersion)
+	if !ok {
+		return false, "", fmt.Errorf("%q is not a semantic version", oldVersion)
+	}
+	n, ok := parseVersion(newVersion)
+	if !ok {
+		return false, "", fmt.Errorf("%q is not a semantic version", newVersion)
+	}
+	if !o.less(n) {
+		return false, "", fmt.Errorf("%s is not newer than %s", newVersion, oldVersion)
+	}
+
+	var incompatible, compatible bool
+	for _, c := range changes {
+		if c.Incompatible {
+			incompatible = true
+		} else {
+			compatible = true
+		}
+	}
+	switch {
+	case n.major != o.major:
+		return false, "A new major version may make incompatible changes.", nil
+	case n.major == 0:
+		return false, "Major version zero is for initial development, anything may change.", nil
+	case incompatible:
+		return true, "Incompatible changes require a new major version.", nil
+	case compatible && n.minor == o.minor:
+		return true, "Compatible changes to the API require a new minor version.", nil
+	default:
+		return false, "The changes are allowed by semantic versioning.", nil
+	}
+}
+
+type version struct {
+	major, minor, patch uint64
+	pre                 string // Pre-release, if any.
+}
+
+// parseVersion parses a semantic version with a "v" prefix, like "v1.2.3-pre+build".
+func parseVersion(v string) (version, bool) {
+	if !strings.HasPrefix(v, "v") {
+		return version{}, false
+	}
+	v = v[1:]
+	if i := strings.IndexByte(v, '+'); i >= 0 {
+		v = v[:i]
+	}
+	var pre string
+	if i := strings.IndexByte(v, '-'); i >= 0 {
+		v, pre = v[:i], v[i+1:]
+		if pre == "" {
+			return version{}, false
+		}
+	}
+	parts := strings.Split(v, ".")
+	if len(parts) != 3 {
+		return version{}, false
+	}
+	var nums [3]uint64
+	for i, p := range parts {
+		if p == "" || len(p) > 1 && p[0] == '0' {
+			return version{}, false
+		}
+		n, err := strconv.ParseUint(p, 10, 64)
+		if err != nil {
+			return version{}, false
+		}
+		nums[i] = n
+	}
+	return version{major: nums[0], minor: nums[1], patch: nums[2], pre: pre}, true
+}
+
+// less reports whether v has lower precedence than w.
+// Pre-releases are compared lexically, which is good enough for ordering here.
+func (v version) less(w version) bool {
+	switch {
+	case v.major != w.major:
+		return v.major < w.major
+	case v.minor != w.minor:
+		return v.minor < w.minor
+	case v.patch != w.patch:
+		return v.patch < w.patch
+	case v.pre == "" || w.pre == "":
+		return v.pre != "" && w.pre == ""
+	default:
+		return v.pre < w.pre
+	}
+}
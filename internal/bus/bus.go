@@ -0,0 +1,264 @@
+// Package bus provides publish/subscribe notification buses, for delivering
+// messages to subscribers in one process, or across multiple processes.
+package bus
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Bus delivers published messages to all subscribers.
+type Bus interface {
+	// Publish delivers msg to all subscribers.
+	// Delivery to subscribers in other processes may be asynchronous.
+	Publish(msg []byte) error
+
+	// Subscribe registers f to be called for each published message.
+	// Calls may happen concurrently.
+	Subscribe(f func(msg []byte))
+}
+
+// Memory is a Bus that delivers messages to subscribers in the same process.
+// The zero value is ready to use.
+type Memory struct {
+	mu   sync.Mutex
+	subs []func(msg []byte)
+}
+
+// NewMemory returns a new in-memory bus.
+func NewMemory() *Memory {
+	return &Memory{}
+}
+
+// Publish calls all subscribers with msg, and returns when they're done.
+func (b *Memory) Publish(msg []byte) error {
+	b.mu.Lock()
+	subs := b.subs
+	b.mu.Unlock()
+	for _, f := range subs {
+		f(msg)
+	}
+	return nil
+}
+
+// Subscribe registers f to be called for each published message.
+func (b *Memory) Subscribe(f func(msg []byte)) {
+	b.mu.Lock()
+	b.subs = append(b.subs[:len(b.subs):len(b.subs)], f)
+	b.mu.Unlock()
+}
+
+const (
+	// maxMessageSize is the maximum size of a message accepted from a peer.
+	maxMessageSize = 1 << 20
+
+	// maxMessageAge is how far the timestamp of a message received from a peer
+	// may be from the current time. Older messages are rejected as replays.
+	maxMessageAge = 5 * time.Minute
+)
+
+// HTTP is a Bus that broadcasts messages to peer processes over HTTP.
+// Each process runs an HTTP bus that serves its ServeHTTP method
+// at an endpoint, and lists the endpoints of all other processes as peers.
+//
+// Published messages are delivered to local subscribers, and POSTed
+// to peers, signed with an HMAC-SHA256 of the shared secret.
+// The signature also covers the sender's origin, a sequence number and
+// a timestamp, so that captured messages can't be replayed: messages with
+// timestamps more than maxMessageAge away, and sequence numbers already seen
+// from their origin, are rejected.
+// Messages received from peers are delivered only to local subscribers,
+// so there are no loops.
+type HTTP struct {
+	local  Memory
+	peers  []string
+	secret []byte
+	client *http.Client
+	origin string // Random, so that sequence numbers are unique across processes and restarts.
+	seq    uint64 // Sequence number of the last published message. Accessed atomically.
+
+	mu   sync.Mutex
+	seen map[string]time.Time // "origin-seq" of received messages -> their timestamp.
+
+	wg sync.WaitGroup // In-flight sends to peers.
+}
+
+// NewHTTP returns a new HTTP bus that broadcasts to peers,
+// which are URLs of other processes' bus endpoints.
+// secret must be shared by all processes, and must not be empty.
+func NewHTTP(peers []string, secret []byte) *HTTP {
+	return &HTTP{
+		peers:  peers,
+		secret: secret,
+		client: &http.Client{Timeout: 10 * time.Second},
+		origin: newOrigin(),
+		seen:   make(map[string]time.Time),
+	}
+}
+
+func newOrigin() string {
+	var b [8]byte
+	_, err := rand.Read(b[:])
+	if err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// Publish delivers msg to local subscribers, and starts sending it to peers.
+// Failures to reach peers are logged.
+func (b *HTTP) Publish(msg []byte) error {
+	h := header{
+		Origin:    b.origin,
+		Seq:       atomic.AddUint64(&b.seq, 1),
+		Timestamp: time.Now().Unix(),
+	}
+	for _, peer := range b.peers {
+		b.wg.Add(1)
+		go func(peer string) {
+			defer b.wg.Done()
+			err := b.send(peer, h, msg)
+			if err != nil {
+				log.Printf("bus: sending to peer %s: %v\n", peer, err)
+			}
+		}(peer)
+	}
+	return b.local.Publish(msg)
+}
+
+// Subscribe registers f to be called for each message
+// published locally or received from a peer.
+func (b *HTTP) Subscribe(f func(msg []byte)) {
+	b.local.Subscribe(f)
+}
+
+// Close waits for in-flight sends to peers to finish.
+func (b *HTTP) Close() error {
+	b.wg.Wait()
+	return nil
+}
+
+// header identifies a message sent to peers.
+type header struct {
+	Origin    string // Origin of the sender.
+	Seq       uint64 // Sequence number of the message at its origin.
+	Timestamp int64  // Time the message was published, in Unix seconds.
+}
+
+func (b *HTTP) send(peer string, h header, msg []byte) error {
+	req, err := http.NewRequest("POST", peer, bytes.NewReader(msg))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("X-Bus-Origin", h.Origin)
+	req.Header.Set("X-Bus-Seq", strconv.FormatUint(h.Seq, 10))
+	req.Header.Set("X-Bus-Timestamp", strconv.FormatInt(h.Timestamp, 10))
+	req.Header.Set("X-Signature-256", "sha256="+hex.EncodeToString(b.sign(h, msg)))
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("non-204 status code: %v", resp.StatusCode)
+	}
+	return nil
+}
+
+// ServeHTTP receives messages sent by peers, and delivers them to local subscribers.
+func (b *HTTP) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "405 Method Not Allowed\n\nmethod should be POST", http.StatusMethodNotAllowed)
+		return
+	}
+	msg, err := io.ReadAll(io.LimitReader(req.Body, maxMessageSize))
+	if err != nil {
+		http.Error(w, "400 Bad Request\n\n"+err.Error(), http.StatusBadRequest)
+		return
+	}
+	h, ok := parseHeader(req.Header)
+	if !ok || !b.verify(h, msg, req.Header.Get("X-Signature-256")) {
+		log.Println("bus: invalid signature for message from", req.RemoteAddr)
+		http.Error(w, "403 Forbidden\n\ninvalid signature", http.StatusForbidden)
+		return
+	}
+	if !b.fresh(h, time.Now()) {
+		log.Printf("bus: rejected replayed or expired message %s-%d from %s\n", h.Origin, h.Seq, req.RemoteAddr)
+		http.Error(w, "403 Forbidden\n\nreplayed or expired message", http.StatusForbidden)
+		return
+	}
+	b.local.Publish(msg)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// parseHeader parses the header of a message sent by a peer.
+func parseHeader(hdr http.Header) (header, bool) {
+	origin := hdr.Get("X-Bus-Origin")
+	seq, err := strconv.ParseUint(hdr.Get("X-Bus-Seq"), 10, 64)
+	if origin == "" || err != nil {
+		return header{}, false
+	}
+	timestamp, err := strconv.ParseInt(hdr.Get("X-Bus-Timestamp"), 10, 64)
+	if err != nil {
+		return header{}, false
+	}
+	return header{Origin: origin, Seq: seq, Timestamp: timestamp}, true
+}
+
+// fresh reports whether a message with header h is received for the first time,
+// within maxMessageAge of its timestamp, and records it as seen if so.
+// Seen messages are forgotten once they'd be rejected as expired anyway.
+func (b *HTTP) fresh(h header, now time.Time) bool {
+	t := time.Unix(h.Timestamp, 0)
+	if t.Before(now.Add(-maxMessageAge)) || t.After(now.Add(maxMessageAge)) {
+		return false
+	}
+	id := fmt.Sprintf("%s-%d", h.Origin, h.Seq)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for id, t := range b.seen {
+		if t.Before(now.Add(-maxMessageAge)) {
+			delete(b.seen, id)
+		}
+	}
+	if _, ok := b.seen[id]; ok {
+		return false
+	}
+	b.seen[id] = t
+	return true
+}
+
+// sign returns the HMAC-SHA256 of h and msg.
+func (b *HTTP) sign(h header, msg []byte) []byte {
+	mac := hmac.New(sha256.New, b.secret)
+	fmt.Fprintf(mac, "%s\n%d\n%d\n", h.Origin, h.Seq, h.Timestamp)
+	mac.Write(msg)
+	return mac.Sum(nil)
+}
+
+// verify reports whether signature is a valid "sha256=<hex>" signature of h and msg.
+func (b *HTTP) verify(h header, msg []byte, signature string) bool {
+	if len(b.secret) == 0 || !strings.HasPrefix(signature, "sha256=") {
+		return false
+	}
+	got, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(got, b.sign(h, msg))
+}
@@ -0,0 +1,182 @@
+package bus_test
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shurcooL/gtdo/internal/bus"
+)
+
+func TestMemory(t *testing.T) {
+	b := bus.NewMemory()
+	var got []string
+	b.Subscribe(func(msg []byte) { got = append(got, "a:"+string(msg)) })
+	b.Subscribe(func(msg []byte) { got = append(got, "b:"+string(msg)) })
+
+	err := b.Publish([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a:hello", "b:hello"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestHTTP(t *testing.T) {
+	const secret = "hunter2"
+
+	// Start three nodes, each with the other two as peers.
+	var buses [3]*bus.HTTP
+	var servers [3]*httptest.Server
+	for i := range servers {
+		i := i
+		servers[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			buses[i].ServeHTTP(w, req)
+		}))
+		defer servers[i].Close()
+	}
+	received := make(chan string, 10)
+	for i := range buses {
+		var peers []string
+		for j, s := range servers {
+			if j != i {
+				peers = append(peers, s.URL)
+			}
+		}
+		buses[i] = bus.NewHTTP(peers, []byte(secret))
+		i := i
+		buses[i].Subscribe(func(msg []byte) { received <- string(rune('0'+i)) + ":" + string(msg) })
+	}
+
+	err := buses[1].Publish([]byte("update"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buses[1].Close()
+
+	got := make(map[string]bool)
+	for len(got) < 3 {
+		select {
+		case r := <-received:
+			if got[r] {
+				t.Errorf("message delivered more than once: %q", r)
+			}
+			got[r] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out; got %v", got)
+		}
+	}
+	for _, want := range []string{"0:update", "1:update", "2:update"} {
+		if !got[want] {
+			t.Errorf("missing delivery %q; got %v", want, got)
+		}
+	}
+	select {
+	case r := <-received:
+		t.Errorf("unexpected extra delivery %q", r)
+	default:
+	}
+}
+
+func TestHTTPBadSignature(t *testing.T) {
+	b := bus.NewHTTP(nil, []byte("hunter2"))
+	b.Subscribe(func([]byte) { t.Error("unexpected delivery") })
+	ts := httptest.NewServer(b)
+	defer ts.Close()
+
+	// A node with a different secret.
+	other := bus.NewHTTP([]string{ts.URL}, []byte("wrong"))
+	other.Publish([]byte("update"))
+	other.Close()
+
+	resp, err := http.Post(ts.URL, "application/octet-stream", strings.NewReader("update"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusForbidden; got != want {
+		t.Errorf("got status %v, want %v", got, want)
+	}
+}
+
+func TestHTTPReplay(t *testing.T) {
+	const secret = "hunter2"
+	b := bus.NewHTTP(nil, []byte(secret))
+	delivered := make(chan string, 10)
+	b.Subscribe(func(msg []byte) { delivered <- string(msg) })
+	ts := httptest.NewServer(b)
+	defer ts.Close()
+
+	// Capture a message sent by a peer.
+	var (
+		captured     http.Header
+		capturedBody string
+	)
+	capture := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		captured, capturedBody = req.Header, string(body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer capture.Close()
+	peer := bus.NewHTTP([]string{capture.URL}, []byte(secret))
+	peer.Publish([]byte("update"))
+	peer.Close()
+
+	// It's delivered the first time, and rejected when replayed.
+	if got, want := post(t, ts.URL, captured, capturedBody), http.StatusNoContent; got != want {
+		t.Fatalf("first: got status %v, want %v", got, want)
+	}
+	if got, want := <-delivered, "update"; got != want {
+		t.Errorf("got delivery %q, want %q", got, want)
+	}
+	if got, want := post(t, ts.URL, captured, capturedBody), http.StatusForbidden; got != want {
+		t.Errorf("replay: got status %v, want %v", got, want)
+	}
+
+	// So are messages with timestamps too far off, even if signed correctly.
+	for _, age := range []time.Duration{-time.Hour, time.Hour} {
+		timestamp := time.Now().Add(age).Unix()
+		mac := hmac.New(sha256.New, []byte(secret))
+		fmt.Fprintf(mac, "%s\n%d\n%d\n%s", "other", 1, timestamp, "update")
+		hdr := http.Header{
+			"X-Bus-Origin":    {"other"},
+			"X-Bus-Seq":       {"1"},
+			"X-Bus-Timestamp": {fmt.Sprint(timestamp)},
+			"X-Signature-256": {"sha256=" + hex.EncodeToString(mac.Sum(nil))},
+		}
+		if got, want := post(t, ts.URL, hdr, "update"), http.StatusForbidden; got != want {
+			t.Errorf("timestamp %v off: got status %v, want %v", age, got, want)
+		}
+	}
+
+	select {
+	case msg := <-delivered:
+		t.Errorf("unexpected delivery %q", msg)
+	default:
+	}
+}
+
+// post POSTs body with the bus headers of hdr to url, and returns the status code.
+func post(t *testing.T, url string, hdr http.Header, body string) int {
+	req, err := http.NewRequest("POST", url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"X-Bus-Origin", "X-Bus-Seq", "X-Bus-Timestamp", "X-Signature-256"} {
+		req.Header.Set(k, hdr.Get(k))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
@@ -0,0 +1,105 @@
+// Package ratelimit provides a keyed token bucket rate limiter.
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Limit describes a token bucket. Tokens are added at Rate per second,
+// up to a maximum of Burst tokens. The zero Limit means no limit.
+type Limit struct {
+	Rate  float64 // Tokens added per second.
+	Burst int     // Maximum number of tokens.
+}
+
+// Unlimited reports whether l imposes no limit.
+func (l Limit) Unlimited() bool { return l.Rate <= 0 && l.Burst <= 0 }
+
+// Limiter is a set of token buckets, one per key, all sharing the same Limit.
+// It's safe for concurrent use.
+type Limiter struct {
+	limit Limit
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+
+	now func() time.Time // For testing.
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time // Time tokens was last updated.
+}
+
+// New returns a new Limiter that applies limit to each key separately.
+func New(limit Limit) *Limiter {
+	return &Limiter{
+		limit:   limit,
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+}
+
+// Allow reports whether an event for key may happen now, and consumes a token if so.
+// Otherwise, it returns how long until the next token will be available.
+func (l *Limiter) Allow(key string) (ok bool, retryAfter time.Duration) {
+	if l == nil || l.limit.Unlimited() {
+		return true, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(l.limit.Burst), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = l.refill(b, now)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	if l.limit.Rate <= 0 {
+		// Tokens are never added back.
+		return false, time.Duration(math.MaxInt64)
+	}
+	wait := time.Duration((1 - b.tokens) / l.limit.Rate * float64(time.Second))
+	return false, wait
+}
+
+// refill returns the number of tokens in b at time now.
+func (l *Limiter) refill(b *bucket, now time.Time) float64 {
+	tokens := b.tokens + now.Sub(b.last).Seconds()*l.limit.Rate
+	return math.Min(tokens, float64(l.limit.Burst))
+}
+
+// sweep removes full buckets, since they're indistinguishable from new ones.
+// It does so at most once a minute. l.mu must be held.
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if l.refill(b, now) >= float64(l.limit.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Len returns the number of keys currently being tracked.
+func (l *Limiter) Len() int {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.buckets)
+}
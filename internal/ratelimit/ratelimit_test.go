@@ -0,0 +1,68 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := New(Limit{Rate: 0.5, Burst: 2})
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.Allow("a"); !ok {
+			t.Fatalf("event %d: got denied, want allowed", i)
+		}
+	}
+	ok, retryAfter := l.Allow("a")
+	if ok {
+		t.Fatal("event 2: got allowed, want denied")
+	}
+	if got, want := retryAfter, 2*time.Second; got != want {
+		t.Errorf("got retryAfter %v, want %v", got, want)
+	}
+
+	// Other keys have their own buckets.
+	if ok, _ := l.Allow("b"); !ok {
+		t.Error("key b: got denied, want allowed")
+	}
+
+	now = now.Add(2 * time.Second)
+	if ok, _ := l.Allow("a"); !ok {
+		t.Error("after refill: got denied, want allowed")
+	}
+	if ok, _ := l.Allow("a"); ok {
+		t.Error("after refill: got allowed, want denied")
+	}
+}
+
+func TestLimiterSweep(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := New(Limit{Rate: 1, Burst: 1})
+	l.now = func() time.Time { return now }
+
+	l.Allow("a")
+	l.Allow("b")
+	if got, want := l.Len(), 2; got != want {
+		t.Fatalf("got Len %v, want %v", got, want)
+	}
+	now = now.Add(time.Hour)
+	l.Allow("c")
+	if got, want := l.Len(), 1; got != want {
+		t.Errorf("after sweep: got Len %v, want %v", got, want)
+	}
+}
+
+func TestUnlimited(t *testing.T) {
+	l := New(Limit{})
+	for i := 0; i < 100; i++ {
+		if ok, _ := l.Allow("a"); !ok {
+			t.Fatalf("event %d: got denied, want allowed", i)
+		}
+	}
+	var nilLimiter *Limiter
+	if ok, _ := nilLimiter.Allow("a"); !ok {
+		t.Error("nil Limiter: got denied, want allowed")
+	}
+}
@@ -0,0 +1,171 @@
+// Package webhook receives push webhooks from code hosting services.
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Push is a push to a repository.
+type Push struct {
+	// ImportPath is the import path of the repository root, e.g., "github.com/user/repo".
+	ImportPath string
+
+	// Ref is the full name of the pushed ref, e.g., "refs/heads/main".
+	// It may be empty if the sender doesn't specify it.
+	Ref string
+}
+
+// maxPayloadSize is the maximum size of a webhook payload that is accepted.
+const maxPayloadSize = 5 << 20
+
+// Handler receives push webhooks and verifies their HMAC-SHA256 signatures.
+// It expects to be mounted with http.StripPrefix, and handles the following paths:
+//
+//	/github   GitHub webhooks, signed via X-Hub-Signature-256 header.
+//	/gitea    Gitea webhooks, signed via X-Gitea-Signature header.
+//	/forgejo  Forgejo webhooks, signed via X-Forgejo-Signature header.
+//	/generic  Generic JSON payload {"import_path": "...", "ref": "..."},
+//	          signed via X-Signature-256 header in the same format as GitHub.
+type Handler struct {
+	// Secret is the key used to verify payload signatures.
+	// If it's empty, all webhooks are rejected.
+	Secret []byte
+
+	// Push is called for each verified push.
+	Push func(Push)
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "405 Method Not Allowed\n\nmethod should be POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var (
+		signature string // Hex-encoded HMAC-SHA256 signature.
+		event     string // Event type, or empty if sender doesn't specify it.
+		parse     func(body []byte) (Push, error)
+	)
+	switch req.URL.Path {
+	case "/github":
+		signature = strings.TrimPrefix(req.Header.Get("X-Hub-Signature-256"), "sha256=")
+		event = req.Header.Get("X-GitHub-Event")
+		parse = parseRepositoryPayload
+	case "/gitea":
+		signature = req.Header.Get("X-Gitea-Signature")
+		event = req.Header.Get("X-Gitea-Event")
+		parse = parseRepositoryPayload
+	case "/forgejo":
+		signature = req.Header.Get("X-Forgejo-Signature")
+		event = req.Header.Get("X-Forgejo-Event")
+		parse = parseRepositoryPayload
+	case "/generic":
+		signature = strings.TrimPrefix(req.Header.Get("X-Signature-256"), "sha256=")
+		event = "push"
+		parse = parseGenericPayload
+	default:
+		http.NotFound(w, req)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxPayloadSize))
+	if err != nil {
+		http.Error(w, "400 Bad Request\n\n"+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !h.verify(body, signature) {
+		log.Printf("webhook: invalid signature for %s payload\n", req.URL.Path)
+		http.Error(w, "403 Forbidden\n\ninvalid signature", http.StatusForbidden)
+		return
+	}
+
+	if event != "push" {
+		// Acknowledge other events (e.g., "ping") without doing anything.
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintf(w, "ignoring %q event\n", event)
+		return
+	}
+	push, err := parse(body)
+	if err != nil {
+		http.Error(w, "400 Bad Request\n\n"+err.Error(), http.StatusBadRequest)
+		return
+	}
+	h.Push(push)
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintf(w, "update of %s enqueued\n", push.ImportPath)
+}
+
+// verify reports whether signature is a valid hex-encoded HMAC-SHA256 of body.
+func (h *Handler) verify(body []byte, signature string) bool {
+	if len(h.Secret) == 0 {
+		return false
+	}
+	got, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, h.Secret)
+	mac.Write(body)
+	return hmac.Equal(got, mac.Sum(nil))
+}
+
+// parseRepositoryPayload parses a push payload in the format
+// used by GitHub, and followed by Gitea and Forgejo.
+func parseRepositoryPayload(body []byte) (Push, error) {
+	var payload struct {
+		Ref        string
+		Repository struct {
+			HTMLURL string `json:"html_url"`
+		}
+	}
+	err := json.Unmarshal(body, &payload)
+	if err != nil {
+		return Push{}, err
+	}
+	importPath, err := importPathFromURL(payload.Repository.HTMLURL)
+	if err != nil {
+		return Push{}, err
+	}
+	return Push{ImportPath: importPath, Ref: payload.Ref}, nil
+}
+
+func parseGenericPayload(body []byte) (Push, error) {
+	var payload struct {
+		ImportPath string `json:"import_path"`
+		Ref        string
+	}
+	err := json.Unmarshal(body, &payload)
+	if err != nil {
+		return Push{}, err
+	}
+	if payload.ImportPath == "" {
+		return Push{}, fmt.Errorf("import_path is empty")
+	}
+	return Push{ImportPath: payload.ImportPath, Ref: payload.Ref}, nil
+}
+
+// importPathFromURL returns the import path that corresponds to repository web URL u,
+// e.g., "github.com/user/repo" for "https://github.com/user/repo".
+func importPathFromURL(u string) (string, error) {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return "", err
+	}
+	if parsed.Host == "" || strings.Trim(parsed.Path, "/") == "" {
+		return "", fmt.Errorf("repository URL %q doesn't have a host and path", u)
+	}
+	path := strings.TrimSuffix(strings.Trim(parsed.Path, "/"), ".git")
+	return parsed.Host + "/" + path, nil
+}
@@ -0,0 +1,188 @@
+package webhook_test
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/shurcooL/gtdo/internal/webhook"
+)
+
+const secret = "hunter2"
+
+func sign(body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+const githubPush = `{
+  "ref": "refs/heads/main",
+  "before": "0000000000000000000000000000000000000000",
+  "after": "1111111111111111111111111111111111111111",
+  "repository": {
+    "full_name": "user/repo",
+    "html_url": "https://github.com/user/repo",
+    "clone_url": "https://github.com/user/repo.git"
+  }
+}`
+
+const giteaPush = `{
+  "ref": "refs/heads/master",
+  "repository": {
+    "full_name": "org/project",
+    "html_url": "https://git.example.com/org/project",
+    "clone_url": "https://git.example.com/org/project.git"
+  }
+}`
+
+func TestHandler(t *testing.T) {
+	var pushes []webhook.Push
+	ts := httptest.NewServer(http.StripPrefix("/-/hooks", &webhook.Handler{
+		Secret: []byte(secret),
+		Push:   func(p webhook.Push) { pushes = append(pushes, p) },
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		name       string
+		path       string
+		header     map[string]string
+		body       string
+		wantStatus int
+		wantPush   *webhook.Push
+	}{
+		{
+			name: "github push",
+			path: "/github",
+			header: map[string]string{
+				"X-GitHub-Event":      "push",
+				"X-Hub-Signature-256": "sha256=" + sign(githubPush),
+			},
+			body:       githubPush,
+			wantStatus: http.StatusAccepted,
+			wantPush:   &webhook.Push{ImportPath: "github.com/user/repo", Ref: "refs/heads/main"},
+		},
+		{
+			name: "github ping",
+			path: "/github",
+			header: map[string]string{
+				"X-GitHub-Event":      "ping",
+				"X-Hub-Signature-256": "sha256=" + sign(`{"zen":"Keep it simple."}`),
+			},
+			body:       `{"zen":"Keep it simple."}`,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name: "github bad signature",
+			path: "/github",
+			header: map[string]string{
+				"X-GitHub-Event":      "push",
+				"X-Hub-Signature-256": "sha256=" + sign("something else"),
+			},
+			body:       githubPush,
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name: "gitea push",
+			path: "/gitea",
+			header: map[string]string{
+				"X-Gitea-Event":     "push",
+				"X-Gitea-Signature": sign(giteaPush),
+			},
+			body:       giteaPush,
+			wantStatus: http.StatusAccepted,
+			wantPush:   &webhook.Push{ImportPath: "git.example.com/org/project", Ref: "refs/heads/master"},
+		},
+		{
+			name: "forgejo push",
+			path: "/forgejo",
+			header: map[string]string{
+				"X-Forgejo-Event":     "push",
+				"X-Forgejo-Signature": sign(giteaPush),
+			},
+			body:       giteaPush,
+			wantStatus: http.StatusAccepted,
+			wantPush:   &webhook.Push{ImportPath: "git.example.com/org/project", Ref: "refs/heads/master"},
+		},
+		{
+			name:       "generic push",
+			path:       "/generic",
+			header:     map[string]string{"X-Signature-256": "sha256=" + sign(`{"import_path": "example.org/repo"}`)},
+			body:       `{"import_path": "example.org/repo"}`,
+			wantStatus: http.StatusAccepted,
+			wantPush:   &webhook.Push{ImportPath: "example.org/repo"},
+		},
+		{
+			name:       "generic missing signature",
+			path:       "/generic",
+			body:       `{"import_path": "example.org/repo"}`,
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "generic missing import path",
+			path:       "/generic",
+			header:     map[string]string{"X-Signature-256": "sha256=" + sign(`{}`)},
+			body:       `{}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "unknown sender",
+			path:       "/gitlab",
+			body:       `{}`,
+			wantStatus: http.StatusNotFound,
+		},
+	}
+	for _, tc := range tests {
+		pushes = nil
+		req, err := http.NewRequest("POST", ts.URL+"/-/hooks"+tc.path, strings.NewReader(tc.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range tc.header {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.wantStatus {
+			t.Errorf("%s: got status %v, want %v", tc.name, resp.StatusCode, tc.wantStatus)
+		}
+		switch {
+		case tc.wantPush == nil && len(pushes) != 0:
+			t.Errorf("%s: got pushes %v, want none", tc.name, pushes)
+		case tc.wantPush != nil && (len(pushes) != 1 || pushes[0] != *tc.wantPush):
+			t.Errorf("%s: got pushes %v, want %v", tc.name, pushes, *tc.wantPush)
+		}
+	}
+}
+
+func TestHandlerNoSecret(t *testing.T) {
+	ts := httptest.NewServer(&webhook.Handler{
+		Push: func(webhook.Push) { t.Error("unexpected push") },
+	})
+	defer ts.Close()
+
+	mac := hmac.New(sha256.New, nil)
+	mac.Write([]byte(githubPush))
+	req, err := http.NewRequest("POST", ts.URL+"/github", strings.NewReader(githubPush))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-GitHub-Event", "push")
+	req.Header.Set("X-Hub-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusForbidden; got != want {
+		t.Errorf("got status %v, want %v", got, want)
+	}
+}
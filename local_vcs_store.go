@@ -19,12 +19,29 @@ type localVCSStore struct {
 }
 
 // Repository opens the specified repo, cloning it if it doesn't already exist.
-func (c *localVCSStore) Repository(vcsType string, cloneURL *url.URL) (_ vcs.Repository, repoDir string, _ error) {
-	repoDir = filepath.Join(c.dir, vcsType, cloneURL.Scheme, filepath.FromSlash(pathpkg.Join(cloneURL.Host, cloneURL.Path)))
+// If permit is non-nil, it's consulted before cloning.
+func (c *localVCSStore) Repository(vcsType string, cloneURL *url.URL, permit permitFunc) (_ vcs.Repository, repoDir string, _ error) {
+	repoDir = c.repoDir(vcsType, cloneURL)
 	repo, err := vcs.Open(vcsType, repoDir)
 	if os.IsNotExist(err) {
+		if permit != nil {
+			if err := permit(opClone); err != nil {
+				return nil, repoDir, err
+			}
+		}
 		opt := vcs.CloneOpt{Bare: true, Mirror: true, RemoteOpts: vcs.RemoteOpts{}}
 		repo, err = vcs.Clone(vcsType, cloneURL.String(), repoDir, opt)
 	}
 	return repo, repoDir, err
 }
+
+// Contains reports whether the specified repo has already been cloned into the store.
+func (c *localVCSStore) Contains(vcsType string, cloneURL *url.URL) bool {
+	_, err := os.Stat(c.repoDir(vcsType, cloneURL))
+	return err == nil
+}
+
+// repoDir returns the directory of the specified repo in the store.
+func (c *localVCSStore) repoDir(vcsType string, cloneURL *url.URL) string {
+	return filepath.Join(c.dir, vcsType, cloneURL.Scheme, filepath.FromSlash(pathpkg.Join(cloneURL.Host, cloneURL.Path)))
+}
@@ -2,6 +2,7 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"compress/gzip"
 	"context"
@@ -11,12 +12,15 @@ import (
 	"fmt"
 	"go/ast"
 	"go/build"
+	"go/build/constraint"
 	"go/parser"
+	"go/scanner"
 	"go/token"
 	"html/template"
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -34,6 +38,7 @@ import (
 	"github.com/shurcooL/go/printerutil"
 	"github.com/shurcooL/gtdo/assets"
 	"github.com/shurcooL/gtdo/gtdo"
+	"github.com/shurcooL/gtdo/internal/bus"
 	"github.com/shurcooL/gtdo/internal/sanitizedanchorname"
 	"github.com/shurcooL/gtdo/page"
 	"github.com/shurcooL/highlight_go"
@@ -59,6 +64,7 @@ var (
 	analyticsFileFlag = flag.String("analytics-file", "", "Optional path to file containing analytics HTML to insert at the beginning of <head>.")
 	vcsStoreDirFlag   = flag.String("vcs-store-dir", "", "Directory of vcs store (required).")
 	stateFileFlag     = flag.String("state-file", "", "File to save/load state.")
+	botPolicyFileFlag = flag.String("bot-policy-file", "", "Optional path to JSON file containing bot and crawler policy.")
 )
 
 func main() {
@@ -68,6 +74,16 @@ func main() {
 		flag.Usage()
 		os.Exit(2)
 	}
+	if *sseHeartbeatFlag < 0 {
+		fmt.Fprintln(os.Stderr, "-sse-heartbeat flag must not be negative")
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *updateWorkersFlag <= 0 || *updateQueueSizeFlag <= 0 || *updateHostConcurrencyFlag < 0 {
+		fmt.Fprintln(os.Stderr, "-update-workers and -update-queue-size flags must be positive, and -update-host-concurrency must not be negative")
+		flag.Usage()
+		os.Exit(2)
+	}
 
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer stop()
@@ -101,17 +117,26 @@ func run(ctx context.Context, analyticsFile string) error {
 	}
 	fmt.Printf("using local Go version %q\n", LocalGoVersion)
 
+	policy, err := loadBotPolicy(*botPolicyFileFlag)
+	if err != nil {
+		return fmt.Errorf("loadBotPolicy: %v", err)
+	}
+
+	trustedProxies, err = parseTrustedProxies(*trustedProxiesFlag)
+	if err != nil {
+		return fmt.Errorf("parseTrustedProxies: %v", err)
+	}
+	limits := newClientLimits()
+
 	h := &handler{
 		analyticsHTML: template.HTML(analyticsHTML),
+		policy:        policy,
+		limits:        limits,
 	}
 	http.HandleFunc("/", h.codeHandler)
 	http.Handle("/favicon.ico", http.NotFoundHandler())
-	http.HandleFunc("/robots.txt", func(w http.ResponseWriter, req *http.Request) {
-		w.Header().Set("Content-Type", "text/plain")
-		io.WriteString(w, `User-agent: *
-Disallow: /
-`)
-	})
+	http.HandleFunc("/robots.txt", policy.RobotsTxt)
+	http.HandleFunc("/sitemap.xml", policy.Sitemap)
 	fileServer := httpgzip.FileServer(assets.Assets, httpgzip.FileServerOptions{ServeError: httpgzip.Detailed})
 	http.Handle("/assets/", fileServer)
 	http.Handle("/assets/frontend.js", http.StripPrefix("/assets", fileServer))
@@ -125,15 +150,47 @@ Disallow: /
 		_ = loadState(*stateFileFlag)
 	}
 
-	RepoUpdater = NewRepoUpdater()
+	RepoUpdater = NewRepoUpdater(*updateWorkersFlag, *updateQueueSizeFlag, *updateHostConcurrencyFlag)
 	defer RepoUpdater.Close()
+	RefreshScheduler = NewRefreshScheduler(*refreshMinIntervalFlag, *refreshMaxIntervalFlag)
+	defer RefreshScheduler.Close()
+	NotifyBus, err = newNotifyBus(*busPeersFlag, *busSecretFileFlag)
+	if err != nil {
+		return fmt.Errorf("newNotifyBus: %v", err)
+	}
+	NotifyBus.Subscribe(receiveChange)
+	if b, ok := NotifyBus.(*bus.HTTP); ok {
+		defer b.Close()
+		http.Handle("/-/bus", b)
+	}
 	sse = make(map[importPathBranch][]pageViewer)
+	sseConnsIP = make(map[string]int)
 	http.HandleFunc("/-/events", eventsHandler)
+	http.HandleFunc("/-/events/ws", wsEventsHandler)
+	http.HandleFunc("/-/events/poll", pollEventsHandler)
+	http.HandleFunc("/-/refresh", h.refreshHandler)
+	http.Handle("/-/status", textHandler(func(w io.Writer, req *http.Request) error {
+		RepoUpdater.WriteFailures(w)
+		return nil
+	}))
+	if *webhookSecretFileFlag != "" {
+		hooks, err := newWebhookHandler(*webhookSecretFileFlag)
+		if err != nil {
+			return fmt.Errorf("newWebhookHandler: %v", err)
+		}
+		http.Handle("/-/hooks/", http.StripPrefix("/-/hooks", hooks))
+	}
 	http.Handle("/-/debug", textHandler(func(w io.Writer, req *http.Request) error {
-		fmt.Fprintln(w, "len(RepoUpdater.queue):", len(RepoUpdater.queue))
+		fmt.Fprintln(w, "repo updater:")
+		RepoUpdater.WriteStatus(w)
+		fmt.Fprintln(w)
+		RefreshScheduler.WriteStatus(w)
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "rate limited clients (pages, fetches, clones, type checks):", limits.pages.Len(), limits.fetches.Len(), limits.clones.Len(), limits.typeChecks.Len())
 		fmt.Fprintln(w)
 		fmt.Fprintln(w, "events:")
 		sseMu.Lock()
+		fmt.Fprintf(w, "open streams: %d from %d clients, last event ID: %q, recent events: %d\n", sseConns, len(sseConnsIP), lastEventID, len(recentEvents))
 		for importPathBranch, pageViewers := range sse {
 			fmt.Fprintf(w, "%#v - %v\n", importPathBranch, len(pageViewers))
 		}
@@ -144,13 +201,21 @@ Disallow: /
 		return nil
 	}))
 
-	server := &http.Server{Addr: *httpFlag, Handler: topMux{}}
+	server := &http.Server{Addr: *httpFlag, Handler: topMux{limits: limits}}
+	server.RegisterOnShutdown(drainEvents)
 
 	go func() {
 		<-ctx.Done()
-		err := server.Close()
+		// Let in-flight requests finish, and event streams drain.
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		err := server.Shutdown(shutdownCtx)
 		if err != nil {
-			log.Println("server.Close:", err)
+			log.Println("server.Shutdown:", err)
+			err = server.Close()
+			if err != nil {
+				log.Println("server.Close:", err)
+			}
 		}
 	}()
 
@@ -211,6 +276,21 @@ func loadTemplates() error {
 
 type handler struct {
 	analyticsHTML template.HTML
+	policy        *botPolicy
+	limits        *clientLimits
+}
+
+// permit returns a permitFunc for costly operations done on behalf of req.
+// It applies the bot policy and the client's budgets.
+func (h *handler) permit(req *http.Request) permitFunc {
+	policy := h.policy.Permit(req)
+	ip := clientIP(req)
+	return func(op costlyOp) error {
+		if err := policy(op); err != nil {
+			return err
+		}
+		return h.limits.Spend(ip, op)
+	}
 }
 
 func (h *handler) codeHandler(w http.ResponseWriter, req *http.Request) {
@@ -219,17 +299,6 @@ func (h *handler) codeHandler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	switch req.UserAgent() {
-	case "Mozilla/5.0 (compatible; Baiduspider/2.0; +http://www.baidu.com/search/spider.html)":
-		log.Printf("blocked request to %q from Baiduspider\n", req.URL.String())
-		http.Error(w, "403 Forbidden\n\nsee robots.txt", http.StatusForbidden)
-		return
-	case "Mozilla/5.0 (compatible; AlphaBot/3.2; +http://alphaseobot.com/bot.html)":
-		log.Printf("blocked request to %q from AlphaBot\n", req.URL.String())
-		http.Error(w, "403 Forbidden\n\nsee robots.txt", http.StatusForbidden)
-		return
-	}
-
 	if !*productionFlag {
 		err := loadTemplates()
 		if err != nil {
@@ -239,6 +308,21 @@ func (h *handler) codeHandler(w http.ResponseWriter, req *http.Request) {
 		}
 	}
 
+	// Redirect "/import/path/" to "/import/path".
+	if req.URL.Path != "/" && req.URL.Path[len(req.URL.Path)-1] == '/' {
+		baseURL := req.URL.Path[:len(req.URL.Path)-1]
+		if req.URL.RawQuery != "" {
+			baseURL += "?" + req.URL.RawQuery
+		}
+		http.Redirect(w, req, baseURL, http.StatusFound)
+		return
+	}
+
+	// Apply the bot policy after redirecting, so it's applied to the canonical path.
+	if !h.policy.Check(w, req, strings.TrimPrefix(req.URL.Path, "/")) {
+		return
+	}
+
 	if req.URL.Path == "/" {
 		w.Header().Set("Content-Type", "text/html; charset=utf-8")
 		recentlyViewed.mu.RLock()
@@ -253,23 +337,28 @@ func (h *handler) codeHandler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	// Redirect "/import/path/" to "/import/path".
-	if req.URL.Path != "/" && req.URL.Path[len(req.URL.Path)-1] == '/' {
-		baseURL := req.URL.Path[:len(req.URL.Path)-1]
-		if req.URL.RawQuery != "" {
-			baseURL += "?" + req.URL.RawQuery
-		}
-		http.Redirect(w, req, baseURL, http.StatusFound)
-		return
-	}
-
 	importPath := req.URL.Path[1:]
 	rev := req.URL.Query().Get(gtdo.RevisionQueryParameter) // rev is the raw revision query parameter as specified by URL.
 	const testsQueryParameter = "tests"
+	const otherFilesQueryParameter = "other"
 	_, includeTestFiles := req.URL.Query()[testsQueryParameter]
+	_, includeOtherFiles := req.URL.Query()[otherFilesQueryParameter]
+	_, filesFragment := req.URL.Query()[gtdo.FilesFragmentQueryParameter]
+	rawQuery := req.URL.RawQuery // rawQuery is used for links within rendered files.
+	if filesFragment {
+		// Links within a files fragment should be the same as in the page it's patched into.
+		query := req.URL.Query()
+		query.Del(gtdo.FilesFragmentQueryParameter)
+		rawQuery = query.Encode()
+	}
 
 	log.Printf("req: importPath=%q rev=%q tab=%v, ref=%q, ua=%q\n", importPath, rev, req.URL.Query().Get("tab"), req.Referer(), req.UserAgent())
 
+	if name := req.URL.Query().Get(gtdo.RawQueryParameter); name != "" {
+		h.rawHandler(w, req, importPath, rev, name)
+		return
+	}
+
 	switch req.URL.Query().Get("tab") {
 	case "summary":
 		h.summaryHandler(w, req, importPath, rev)
@@ -280,19 +369,24 @@ func (h *handler) codeHandler(w http.ResponseWriter, req *http.Request) {
 	case "dependents":
 		h.dependentsHandler(w, req, importPath, rev)
 		return
+	case "api":
+		h.apiHandler(w, req, importPath, rev)
+		return
 	}
 
-	source, bpkg, repoSpec, repoImportPath, commit, fs, branches, defaultBranch, err := try(importPath, rev)
+	target := buildTargetFromQuery(req.URL.Query())
+	source, bpkg, repoSpec, repoImportPath, commit, fs, branches, defaultBranch, err := try(importPath, rev, target, h.permit(req))
 	log.Println("using source:", source)
 	if err != nil {
 		log.Println("try:", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		tryError(w, err)
 		return
 	}
 
 	frontendState := page.State{
-		ImportPath:   importPath,
-		ProcessedRev: rev,
+		ImportPath:     importPath,
+		RepoImportPath: repoImportPath,
+		ProcessedRev:   rev,
 	}
 	if frontendState.ProcessedRev == "" && len(branches) != 0 {
 		frontendState.ProcessedRev = defaultBranch
@@ -313,12 +407,16 @@ func (h *handler) codeHandler(w http.ResponseWriter, req *http.Request) {
 		ImportPath         string
 		ImportPathElements template.HTML // Import path with linkified elements.
 		Commit             *vcs.Commit
+		Unreachable        *updateFailure // Non-nil if the repository has been failing to update for a long time.
 		DirExists          bool
 		Bpkg               *build.Package
 		Folders            []string
 		Files              template.HTML
 		Branches           template.HTML // Select menu for branches.
 		Tests              template.HTML // Checkbox for tests.
+		OtherFiles         template.HTML // Checkbox for other files.
+		Live               template.HTML // Checkbox for live updates.
+		Platform           platformSelector
 	}{
 		FrontendState:      frontendState,
 		AnalyticsHTML:      h.analyticsHTML,
@@ -327,9 +425,13 @@ func (h *handler) codeHandler(w http.ResponseWriter, req *http.Request) {
 		ImportPath:         importPath,
 		ImportPathElements: page.ImportPathElementsHTML(repoImportPath, importPath, req.URL.RawQuery),
 		Commit:             commit,
+		Unreachable:        RepoUpdater.Unreachable(repoSpec),
 		DirExists:          fs != nil,
 		Bpkg:               bpkg,
 		Tests:              checkbox.New(false, req.URL.Query(), testsQueryParameter),
+		OtherFiles:         checkbox.New(false, req.URL.Query(), otherFilesQueryParameter),
+		Live:               checkbox.New(false, req.URL.Query(), gtdo.LiveQueryParameter),
+		Platform:           newPlatformSelector(req.URL.Query()),
 	}
 
 	// Folders.
@@ -356,137 +458,208 @@ func (h *handler) codeHandler(w http.ResponseWriter, req *http.Request) {
 	if bpkg != nil {
 		var buf bytes.Buffer
 
-		// Get all .go files, sort by name.
-		goFiles := append(bpkg.GoFiles, bpkg.CgoFiles...)
-		if includeTestFiles {
-			goFiles = append(goFiles, bpkg.TestGoFiles...)
-			goFiles = append(goFiles, bpkg.XTestGoFiles...)
-		}
-		for _, goFile := range bpkg.IgnoredGoFiles {
-			isTest := strings.HasSuffix(goFile, "_test.go") // Logic from go/build.
-			// When we care about differentiating test files in/outside package,
-			// then need to calculate isXTest correctly, likely by doing
-			// parser.ParseFile(..., parser.PackageClauseOnly) again.
-			if !isTest || includeTestFiles {
-				goFiles = append(goFiles, goFile)
-			}
-		}
-		sort.Strings(goFiles)
+		// Group files by whether and why they're part of the package.
+		groups := classifyFiles(importContext(source, fs, target), bpkg, includeTestFiles)
+		embedded := resolveEmbedPatterns(fs, bpkg, includeTestFiles)
+		asm := asmSymbols(fs, bpkg)
 
-		for _, goFile := range goFiles {
-			fi, err := fs.Stat(path.Join(bpkg.Dir, goFile))
-			if err != nil {
-				panic(fmt.Errorf("%v: fs.Stat(%q): %v", fs.String(), path.Join(bpkg.Dir, goFile), err))
-			}
-			file, err := fs.Open(path.Join(bpkg.Dir, goFile))
-			if err != nil {
-				panic(fmt.Errorf("%v: fs.Open(%q): %v", fs.String(), path.Join(bpkg.Dir, goFile), err))
+		for _, group := range groups {
+			if heading := group.Heading(); heading != "" {
+				fmt.Fprintf(&buf, `<div class="file-group"><strong>%s</strong> %s</div>`, html.EscapeString(heading), html.EscapeString(group.Explanation(bpkg, target)))
 			}
-			src, err := ioutil.ReadAll(file)
-			if err != nil {
-				panic(err)
-			}
-			err = file.Close()
-			if err != nil {
-				panic(err)
+			if group.Class == otherFile && !includeOtherFiles {
+				// Only list other files, linking to them with other files displayed.
+				query, _ := url.ParseQuery(rawQuery)
+				query.Set(otherFilesQueryParameter, "")
+				io.WriteString(&buf, `<ul class="other-files">`)
+				for _, name := range group.Files {
+					u := url.URL{RawQuery: query.Encode(), Fragment: sanitizedanchorname.Create(name)}
+					fmt.Fprintf(&buf, `<li><a href="%s">%s</a></li>`, html.EscapeString(u.String()), html.EscapeString(name))
+				}
+				io.WriteString(&buf, `</ul>`)
+				continue
 			}
-
-			const maxAnnotateSize = 1000 * 1000
-
-			var (
-				annSrc           []byte
-				shouldHTMLEscape bool
-			)
-			switch {
-			case fi.Size() <= maxAnnotateSize:
-				fset := token.NewFileSet()
-				fileAst, err := parser.ParseFile(fset, filepath.Join(bpkg.Dir, goFile), src, parser.ParseComments)
+			for _, goFile := range group.Files {
+				fi, err := fs.Stat(path.Join(bpkg.Dir, goFile))
+				if err != nil {
+					panic(fmt.Errorf("%v: fs.Stat(%q): %v", fs.String(), path.Join(bpkg.Dir, goFile), err))
+				}
+				if group.Class == otherFile {
+					err := writeOtherFile(&buf, fs, bpkg.Dir, goFile, fi, rawURL(importPath, goFile, frontendState.ProcessedRev).String())
+					if err != nil {
+						panic(fmt.Errorf("%v: writeOtherFile(%q): %v", fs.String(), path.Join(bpkg.Dir, goFile), err))
+					}
+					continue
+				}
+				file, err := fs.Open(path.Join(bpkg.Dir, goFile))
 				if err != nil {
-					log.Println("parser.ParseFile:", err)
+					panic(fmt.Errorf("%v: fs.Open(%q): %v", fs.String(), path.Join(bpkg.Dir, goFile), err))
 				}
-				if fileAst == nil {
-					panic(fmt.Errorf("internal error: this shouldn't happen as long as parser.ParseFile is still given []byte as src"))
+				src, err := ioutil.ReadAll(file)
+				if err != nil {
+					panic(err)
+				}
+				err = file.Close()
+				if err != nil {
+					panic(err)
 				}
 
-				anns, err := highlight_go.Annotate(src, htmlAnnotator)
-				_ = err // TODO: Deal with returned error.
-
-				for _, decl := range fileAst.Decls {
-					switch d := decl.(type) {
-					case *ast.FuncDecl:
-						name := d.Name.String()
-						if d.Recv != nil {
-							name = strings.TrimPrefix(printerutil.SprintAstBare(d.Recv.List[0].Type), "*") + "." + name
-							anns = append(anns, annotateNodes(fset, d.Recv, d.Name, fmt.Sprintf(`<h3 id="%s">`, name), `</h3>`, 1))
-						} else {
-							anns = append(anns, annotateNode(fset, d.Name, fmt.Sprintf(`<h3 id="%s">`, name), `</h3>`, 1))
-						}
-						anns = append(anns, annotateNode(fset, d.Name, fmt.Sprintf(`<a href="%s">`, "#"+name), `</a>`, 2))
-					case *ast.GenDecl:
-						switch d.Tok {
-						case token.IMPORT:
-							for _, imp := range d.Specs {
-								pathLit := imp.(*ast.ImportSpec).Path
-								pathValue, err := strconv.Unquote(pathLit.Value)
-								if err != nil {
-									continue
-								}
-								url := importPathURL(pathValue, repoImportPath, req.URL.RawQuery)
-								anns = append(anns, annotateNode(fset, pathLit, fmt.Sprintf(`<a href="%s">`, url), `</a>`, 1))
+				var (
+					annSrc           []byte
+					shouldHTMLEscape bool
+					folds            []fold
+					syntaxErrs       scanner.ErrorList
+				)
+				switch {
+				case fi.Size() <= maxAnnotateSize:
+					fset := token.NewFileSet()
+					fileAst, err := parser.ParseFile(fset, filepath.Join(bpkg.Dir, goFile), src, parser.ParseComments)
+					if err != nil {
+						log.Println("parser.ParseFile:", err)
+						// Display syntax errors, and annotate the parts of the file that parsed.
+						syntaxErrs, _ = err.(scanner.ErrorList)
+					}
+					if fileAst == nil {
+						panic(fmt.Errorf("internal error: this shouldn't happen as long as parser.ParseFile is still given []byte as src"))
+					}
+
+					anns, err := highlight_go.Annotate(src, htmlAnnotator)
+					if err != nil {
+						log.Println("highlight_go.Annotate:", err)
+					}
+
+					for _, decl := range fileAst.Decls {
+						switch d := decl.(type) {
+						case *ast.FuncDecl:
+							name := d.Name.String()
+							class := deprecatedClass(d.Doc)
+							if d.Recv != nil && len(d.Recv.List) != 0 {
+								name = strings.TrimPrefix(printerutil.SprintAstBare(d.Recv.List[0].Type), "*") + "." + name
+								anns = append(anns, annotateNodes(fset, d.Recv, d.Name, fmt.Sprintf(`<h3 id="%s" data-kind="method"%s>`, name, class), `</h3>`, 1))
+							} else {
+								anns = append(anns, annotateNode(fset, d.Name, fmt.Sprintf(`<h3 id="%s" data-kind="func"%s>`, name, class), `</h3>`, 1))
 							}
-						case token.TYPE:
-							for _, spec := range d.Specs {
-								ident := spec.(*ast.TypeSpec).Name
-								anns = append(anns, annotateNode(fset, ident, fmt.Sprintf(`<h3 id="%s">`, ident.String()), `</h3>`, 1))
-								anns = append(anns, annotateNode(fset, ident, fmt.Sprintf(`<a href="%s">`, "#"+ident.String()), `</a>`, 2))
+							href := "#" + name
+							if sym, ok := asm[name]; ok && d.Body == nil && d.Recv == nil {
+								// Link to the assembly implementation, displaying other files if needed.
+								u := url.URL{Fragment: sym.Anchor()}
+								if !includeOtherFiles {
+									query, _ := url.ParseQuery(rawQuery)
+									query.Set(otherFilesQueryParameter, "")
+									u.RawQuery = query.Encode()
+								}
+								href = u.String()
 							}
-						case token.CONST, token.VAR:
-							for _, spec := range d.Specs {
-								for _, ident := range spec.(*ast.ValueSpec).Names {
-									anns = append(anns, annotateNode(fset, ident, fmt.Sprintf(`<h3 id="%s">`, ident.String()), `</h3>`, 1))
+							anns = append(anns, annotateNode(fset, d.Name, fmt.Sprintf(`<a href="%s">`, html.EscapeString(href)), `</a>`, 2))
+						case *ast.GenDecl:
+							switch d.Tok {
+							case token.IMPORT:
+								for _, imp := range d.Specs {
+									pathLit := imp.(*ast.ImportSpec).Path
+									pathValue, err := strconv.Unquote(pathLit.Value)
+									if err != nil {
+										continue
+									}
+									url := importPathURL(pathValue, repoImportPath, rawQuery)
+									anns = append(anns, annotateNode(fset, pathLit, fmt.Sprintf(`<a href="%s">`, url), `</a>`, 1))
+								}
+							case token.TYPE:
+								for _, spec := range d.Specs {
+									ident := spec.(*ast.TypeSpec).Name
+									class := deprecatedClass(d.Doc, spec.(*ast.TypeSpec).Doc)
+									anns = append(anns, annotateNode(fset, ident, fmt.Sprintf(`<h3 id="%s" data-kind="type"%s>`, ident.String(), class), `</h3>`, 1))
 									anns = append(anns, annotateNode(fset, ident, fmt.Sprintf(`<a href="%s">`, "#"+ident.String()), `</a>`, 2))
 								}
+							case token.CONST, token.VAR:
+								for _, spec := range d.Specs {
+									class := deprecatedClass(d.Doc, spec.(*ast.ValueSpec).Doc)
+									for _, ident := range spec.(*ast.ValueSpec).Names {
+										anns = append(anns, annotateNode(fset, ident, fmt.Sprintf(`<h3 id="%s" data-kind="%s"%s>`, ident.String(), d.Tok, class), `</h3>`, 1))
+										anns = append(anns, annotateNode(fset, ident, fmt.Sprintf(`<a href="%s">`, "#"+ident.String()), `</a>`, 2))
+									}
+								}
 							}
 						}
 					}
-				}
 
-				sort.Sort(anns)
+					anns = append(anns, cgoLinks(fset, fileAst, goFile)...)
 
-				annSrc, err = annotate.Annotate(src, anns, template.HTMLEscape)
-				if err != nil {
-					panic(err)
+					// Link //go:embed patterns to the files they match.
+					for _, cg := range fileAst.Comments {
+						for _, c := range cg.List {
+							for _, arg := range embedDirectiveArgs(c.Text) {
+								files := embedded[arg.Pattern]
+								if len(files) == 0 {
+									continue
+								}
+								href := "#embedded-files"
+								if len(files) == 1 {
+									href = rawURL(importPath, files[0], frontendState.ProcessedRev).String()
+								}
+								start := fileOffset(fset, c.Pos()) + arg.Offset
+								anns = append(anns, &annotate.Annotation{
+									Start:     start,
+									End:       start + arg.Len,
+									WantInner: 1,
+
+									Left:  []byte(fmt.Sprintf(`<a href="%s">`, html.EscapeString(href))),
+									Right: []byte(`</a>`),
+								})
+							}
+						}
+					}
+
+					folds = goFolds(fset, fileAst, src)
+					anns = append(anns, foldAnnotations(goFile, folds)...)
+					anns = append(anns, syntaxErrorAnnotations(src, syntaxErrs)...)
+
+					sort.Sort(anns)
+
+					annSrc, err = annotate.Annotate(src, anns, template.HTMLEscape)
+					if err != nil {
+						log.Println("annotate.Annotate:", err)
+						annSrc, shouldHTMLEscape, folds = src, true, nil
+						break
+					}
+					shouldHTMLEscape = false
+				default:
+					// Skip annotation for huge files.
+					annSrc = src
+					shouldHTMLEscape = true
 				}
-				shouldHTMLEscape = false
-			default:
-				// Skip annotation for huge files.
-				annSrc = src
-				shouldHTMLEscape = true
-			}
 
-			lineCount := bytes.Count(src, []byte("\n"))
-			fmt.Fprintf(&buf, `<div><h2 id="%s">%s<a class="anchor" onclick="MustScrollTo(event, &#34;\&#34;%s\&#34;&#34;);"><span class="anchor-icon">%s</span></a></h2>`, sanitizedanchorname.Create(goFile), html.EscapeString(goFile), sanitizedanchorname.Create(goFile), linkOcticon) // HACK.
-			io.WriteString(&buf, `<div class="highlight">`)
-			io.WriteString(&buf, `<div class="background"></div>`)
-			io.WriteString(&buf, `<div class="selection"></div>`)
-			io.WriteString(&buf, `<table cellspacing=0><tr><td><pre class="ln">`)
-			for i := 1; i <= lineCount; i++ {
-				fmt.Fprintf(&buf, `<span id="%s-L%d" class="ln" onclick="LineNumber(event, &#34;\&#34;%s-L%d\&#34;&#34;);">%d</span>`, sanitizedanchorname.Create(goFile), i, sanitizedanchorname.Create(goFile), i, i)
-				buf.WriteString("\n")
+				var buildAttr string
+				if expr := buildConstraint(src); expr != "" {
+					buildAttr = fmt.Sprintf(` data-build="%s"`, html.EscapeString(expr))
+				}
+				writeFileHeader(&buf, goFile, buildAttr)
+				writeFileSource(&buf, goFile, src, annSrc, shouldHTMLEscape, folds, syntaxErrs)
 			}
-			io.WriteString(&buf, `</pre></td><td><pre class="file">`)
-			switch shouldHTMLEscape {
-			case false:
-				buf.Write(annSrc)
-			case true:
-				template.HTMLEscape(&buf, annSrc)
+		}
+
+		if files := embeddedFileList(embedded); len(files) != 0 {
+			io.WriteString(&buf, `<div class="file-group" id="embedded-files"><strong>Embedded files</strong> They're embedded in the package by //go:embed directives.</div>`)
+			io.WriteString(&buf, `<ul class="other-files">`)
+			for _, name := range files {
+				fmt.Fprintf(&buf, `<li><a href="%s">%s</a></li>`, html.EscapeString(rawURL(importPath, name, frontendState.ProcessedRev).String()), html.EscapeString(name))
 			}
-			io.WriteString(&buf, `</pre></td></tr></table></div></div>`)
+			io.WriteString(&buf, `</ul>`)
 		}
 
 		data.Files = template.HTML(buf.String())
 	}
 
+	if filesFragment {
+		// Only the rendered files are needed, to be patched into an already open page.
+		// It's not a page view, so don't count it as one.
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if commit != nil {
+			w.Header().Set(gtdo.CommitIDHeader, string(commit.ID))
+		}
+		io.WriteString(w, string(data.Files))
+		return
+	}
+
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	var wr io.Writer = w
 	if httpguts.HeaderValuesContainsToken(req.Header["Accept-Encoding"], "gzip") {
@@ -505,6 +678,46 @@ func (h *handler) codeHandler(w http.ResponseWriter, req *http.Request) {
 	}
 
 	sendToTopMaybe(bpkg)
+	scheduleRefresh(importPath, repoSpec)
+}
+
+// buildConstraint returns the build constraint of Go source file src as
+// a //go:build expression, or "" if it has none. Old-style // +build lines
+// are combined into an equivalent expression.
+func buildConstraint(src []byte) string {
+	var plusBuild constraint.Expr
+	for _, line := range strings.Split(string(src), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "":
+			continue
+		case !strings.HasPrefix(line, "//"):
+			// Build constraints must appear before the package clause,
+			// and we don't bother with ones after a block comment.
+			if plusBuild != nil {
+				return plusBuild.String()
+			}
+			return ""
+		case constraint.IsGoBuild(line):
+			if expr, err := constraint.Parse(line); err == nil {
+				return expr.String()
+			}
+		case constraint.IsPlusBuild(line):
+			expr, err := constraint.Parse(line)
+			if err != nil {
+				continue
+			}
+			if plusBuild == nil {
+				plusBuild = expr
+			} else {
+				plusBuild = &constraint.AndExpr{X: plusBuild, Y: expr}
+			}
+		}
+	}
+	if plusBuild != nil {
+		return plusBuild.String()
+	}
+	return ""
 }
 
 // sendToTopMaybe sends package to top, if bpkg is not nil and doesn't have a conflicting import comment.
@@ -522,8 +735,64 @@ func sendToTopMaybe(bpkg *build.Package) {
 	// it can be directly sent. Otherwise we might have an update before the SSE client connected.
 }
 
+// costlyOp is an expensive operation that try or a handler may need to perform.
+type costlyOp int
+
+const (
+	opClone     costlyOp = iota // Cloning a repository that isn't in the vcs store yet.
+	opFetch                     // Fetching new commits into a repository in the vcs store.
+	opTypeCheck                 // Type-checking the import closure of a package, for the API tab.
+)
+
+func (op costlyOp) String() string {
+	switch op {
+	case opClone:
+		return "clone a new repository"
+	case opFetch:
+		return "fetch new commits"
+	case opTypeCheck:
+		return "type-check packages"
+	default:
+		return fmt.Sprintf("costlyOp(%d)", int(op))
+	}
+}
+
+// permitFunc is consulted before a costly operation is performed on behalf of a request.
+// If it returns a non-nil error, the operation is not performed and the error is returned.
+type permitFunc func(costlyOp) error
+
+// tryError replies to the request with an error returned by try.
+func tryError(w http.ResponseWriter, err error) {
+	var rateLimitErr *rateLimitError
+	switch {
+	case errors.Is(err, errCloneNotPermitted):
+		http.Error(w, "403 Forbidden\n\n"+err.Error(), http.StatusForbidden)
+	case errors.As(err, &rateLimitErr):
+		tooManyRequests(w, rateLimitErr.RetryAfter, rateLimitErr.Error())
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// isPermitError reports whether err was returned by a permitFunc,
+// because the operation wasn't permitted.
+func isPermitError(err error) bool {
+	var rateLimitErr *rateLimitError
+	return errors.Is(err, errCloneNotPermitted) || errors.As(err, &rateLimitErr)
+}
+
+// scheduleRefresh records a view of importPath in repository repoSpec, if not nil,
+// so that the repository is refreshed periodically while it's popular.
+func scheduleRefresh(importPath string, repoSpec *repoSpec) {
+	if repoSpec == nil {
+		return
+	}
+	RefreshScheduler.Viewed(importPathRepoSpec{importPath: importPath, repoSpec: *repoSpec})
+}
+
 // Try local first, if not, try remote, if not, clone/update remote and try one last time.
-func try(importPath, rev string) (
+// The package is resolved for build target. permit is consulted before performing costly operations.
+func try(importPath, rev string, target buildTarget, permit permitFunc) (
 	source string,
 	bpkg *build.Package,
 	repoSpec *repoSpec,
@@ -537,14 +806,14 @@ func try(importPath, rev string) (
 	var repo vcs.Repository
 	var commitId vcs.CommitID
 	if isLocal(importPath) {
-		repo, repoSpec, commitId, defaultBranch, err = tryRemoteGoroot(rev)
+		repo, repoSpec, commitId, defaultBranch, err = tryRemoteGoroot(rev, permit)
 		if err != nil {
 			return source, nil, nil, "", nil, nil, nil, "", err
 		}
 		source = "remote-goroot"
 		repoImportPath = strings.Split(importPath, "/")[0]
 	} else {
-		repo, repoSpec, repoImportPath, commitId, defaultBranch, err = tryRemote(importPath, rev)
+		repo, repoSpec, repoImportPath, commitId, defaultBranch, err = tryRemote(importPath, rev, permit)
 		if err != nil {
 			return source, nil, nil, "", nil, nil, nil, "", err
 		}
@@ -578,13 +847,7 @@ func try(importPath, rev string) (
 		return source, nil, repoSpec, repoImportPath, nil, nil, branchNames, defaultBranch, nil
 	}
 
-	context := buildContextUsingFS(fs)
-	switch source {
-	case "remote-goroot":
-		context.GOROOT = "/virtual-go-workspace"
-	default:
-		context.GOPATH = "/virtual-go-workspace"
-	}
+	context := importContext(source, fs, target)
 	bpkg, err = context.Import(importPath, "", build.ImportComment)
 	_ = err // TODO: Deal with returned error.
 	if bpkg == nil || bpkg.Dir == "" {
@@ -594,6 +857,20 @@ func try(importPath, rev string) (
 	return source, bpkg, repoSpec, repoImportPath, commit, fs, branchNames, defaultBranch, nil
 }
 
+// importContext returns a build context for importing packages from fs,
+// a file system returned by try from the given source, for build target.
+func importContext(source string, fs vfs.FileSystem, target buildTarget) build.Context {
+	context := buildContextUsingFS(fs)
+	target.apply(&context)
+	switch source {
+	case "remote-goroot":
+		context.GOROOT = "/virtual-go-workspace"
+	default:
+		context.GOPATH = "/virtual-go-workspace"
+	}
+	return context
+}
+
 // isLocal reports whether the import path is a package that can only
 // be in a local GOROOT or GOPATH, but not available remotely. It checks
 // if the first element (i.e., the domain name) contains a dot.
@@ -601,7 +878,7 @@ func isLocal(importPath string) bool {
 	return !strings.Contains(strings.Split(importPath, "/")[0], ".")
 }
 
-func tryRemoteGoroot(rev string) (
+func tryRemoteGoroot(rev string, permit permitFunc) (
 	repo vcs.Repository,
 	_ *repoSpec,
 	commitId vcs.CommitID,
@@ -612,7 +889,7 @@ func tryRemoteGoroot(rev string) (
 	if err != nil {
 		return nil, nil, "", "", err
 	}
-	repo, _, err = vs.Repository("git", u)
+	repo, _, err = vs.Repository("git", u, permit)
 	if err != nil {
 		return nil, nil, "", "", err
 	}
@@ -629,6 +906,11 @@ func tryRemoteGoroot(rev string) (
 		commitId, err = repo.ResolveTag(defaultBranch)
 	}
 	if err != nil {
+		if permit != nil {
+			if err1 := permit(opFetch); err1 != nil {
+				return nil, nil, "", "", err1
+			}
+		}
 		_, err1 := repo.(vcs.RemoteUpdater).UpdateEverything(vcs.RemoteOpts{})
 		fmt.Println("tryRemoteGoroot: UpdateEverything:", err1)
 		if err1 != nil {
@@ -673,7 +955,7 @@ func (r repoWithLocal) FileSystem(at vcs.CommitID) (vfs.FileSystem, error) {
 	return r.Repository.FileSystem(at)
 }
 
-func tryRemote(importPath, rev string) (
+func tryRemote(importPath, rev string, permit permitFunc) (
 	repo vcs.Repository,
 	_ *repoSpec,
 	repoImportPath string,
@@ -703,7 +985,7 @@ func tryRemote(importPath, rev string) (
 		return nil, nil, "", "", "", err
 	}
 	var repoDir string
-	repo, repoDir, err = vs.Repository(rr.VCS.Cmd, u)
+	repo, repoDir, err = vs.Repository(rr.VCS.Cmd, u, permit)
 	if err != nil {
 		return nil, nil, "", "", "", err
 	}
@@ -720,6 +1002,11 @@ func tryRemote(importPath, rev string) (
 		commitId, err = repo.ResolveBranch(defaultBranch)
 	}
 	if err != nil {
+		if permit != nil {
+			if err1 := permit(opFetch); err1 != nil {
+				return nil, nil, "", "", "", err1
+			}
+		}
 		_, err1 := repo.(vcs.RemoteUpdater).UpdateEverything(vcs.RemoteOpts{})
 		fmt.Println("tryRemote: UpdateEverything:", err1)
 		if err1 != nil {
@@ -833,11 +1120,21 @@ var linkOcticon = func() string {
 	return buf.String()
 }()
 
-// topMux adds some instrumentation on top of http.DefaultServeMux.
-type topMux struct{}
+// topMux adds some instrumentation and per-client rate limiting on top of http.DefaultServeMux.
+type topMux struct {
+	limits *clientLimits
+}
 
-func (topMux) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+func (m topMux) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	path := req.URL.Path
+	if !exemptFromPageBudget(path) {
+		ip := clientIP(req)
+		if ok, retryAfter := m.limits.pages.Allow(ip); !ok {
+			log.Printf("rate limited request to %q from client %v\n", req.URL.String(), ip)
+			tooManyRequests(w, retryAfter, "please retry later")
+			return
+		}
+	}
 	started := time.Now()
 	rw := &responseWriter{ResponseWriter: w}
 	http.DefaultServeMux.ServeHTTP(rw, req)
@@ -850,6 +1147,17 @@ func (topMux) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// exemptFromPageBudget reports whether requests to path don't count toward
+// per-client page budgets. Those are assets, messages from peer instances,
+// event streams, which are limited by open connections per client instead,
+// and webhooks, which are authenticated.
+func exemptFromPageBudget(path string) bool {
+	return strings.HasPrefix(path, "/assets/") ||
+		path == "/-/bus" ||
+		path == "/-/events" || strings.HasPrefix(path, "/-/events/") ||
+		strings.HasPrefix(path, "/-/hooks/")
+}
+
 // haveType reports whether w has the Content-Type header set.
 func haveType(w http.ResponseWriter) bool {
 	_, ok := w.Header()["Content-Type"]
@@ -874,3 +1182,7 @@ func (rw *responseWriter) Write(p []byte) (n int, err error) {
 func (rw *responseWriter) Flush() {
 	rw.ResponseWriter.(http.Flusher).Flush()
 }
+
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return rw.ResponseWriter.(http.Hijacker).Hijack()
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"strings"
+	"sync/atomic"
+
+	"github.com/shurcooL/gtdo/internal/bus"
+	"github.com/shurcooL/gtdo/page"
+	"sourcegraph.com/sourcegraph/go-vcs/vcs"
+)
+
+var (
+	busPeersFlag      = flag.String("bus-peers", "", "Comma-separated list of URLs of /-/bus endpoints of other gtdo instances, to notify their page viewers of repository changes. If empty, only this instance's viewers are notified.")
+	busSecretFileFlag = flag.String("bus-secret-file", "", "Path to file containing the secret shared with -bus-peers (required if -bus-peers is set).")
+)
+
+// NotifyBus carries repository changes to all gtdo instances,
+// so that page viewers are notified no matter which instance did the update.
+var NotifyBus bus.Bus
+
+// newNotifyBus returns an in-memory bus if peers is empty,
+// or an HTTP bus that broadcasts to peers otherwise.
+func newNotifyBus(peers, secretFile string) (bus.Bus, error) {
+	if peers == "" {
+		return bus.NewMemory(), nil
+	}
+	if secretFile == "" {
+		return nil, errors.New("-bus-secret-file is required when -bus-peers is set")
+	}
+	secret, err := ioutil.ReadFile(secretFile)
+	if err != nil {
+		return nil, err
+	}
+	secret = []byte(strings.TrimSpace(string(secret)))
+	if len(secret) == 0 {
+		return nil, errors.New("bus secret is empty")
+	}
+	var urls []string
+	for _, peer := range strings.Split(peers, ",") {
+		peer = strings.TrimSpace(peer)
+		if peer == "" {
+			continue
+		}
+		if _, err := url.Parse(peer); err != nil {
+			return nil, err
+		}
+		urls = append(urls, peer)
+	}
+	return bus.NewHTTP(urls, secret), nil
+}
+
+// changeMessage is published on NotifyBus when a repository update finds a change.
+type changeMessage struct {
+	// ID identifies the event on all instances, so that clients that reconnect
+	// to a different instance are replayed the events they missed.
+	// It's the origin instance's busOrigin and its sequence number there.
+	ID       string
+	VCSType  string
+	CloneURL string
+	Event    page.OutdatedEvent
+}
+
+var (
+	// busOrigin identifies this instance in IDs of events it publishes.
+	// It's random, so that IDs are unique across instances and restarts.
+	busOrigin = newBusOrigin()
+
+	// busSeq is the sequence number of the last event this instance published.
+	busSeq uint64
+)
+
+func newBusOrigin() string {
+	var b [8]byte
+	_, err := rand.Read(b[:])
+	if err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// publishChange publishes a change event of repository rs.
+func publishChange(rs repoSpec, event page.OutdatedEvent) {
+	id := fmt.Sprintf("%s-%d", busOrigin, atomic.AddUint64(&busSeq, 1))
+	msg, err := json.Marshal(changeMessage{ID: id, VCSType: rs.vcsType, CloneURL: rs.cloneURL, Event: event})
+	if err != nil {
+		log.Println("publishChange: json.Marshal:", err)
+		return
+	}
+	err = NotifyBus.Publish(msg)
+	if err != nil {
+		log.Println("publishChange: NotifyBus.Publish:", err)
+	}
+}
+
+// receiveChange notifies this instance's page viewers of a change published on NotifyBus.
+func receiveChange(msg []byte) {
+	var change changeMessage
+	err := json.Unmarshal(msg, &change)
+	if err != nil {
+		log.Println("receiveChange: json.Unmarshal:", err)
+		return
+	}
+	rs := repoSpec{vcsType: change.VCSType, cloneURL: change.CloneURL}
+
+	// Open the repository to check which viewed packages are affected,
+	// but don't clone it just for that. If it can't be opened, or it's from
+	// another instance that hasn't seen the new commit, all are assumed affected.
+	var repo vcs.Repository
+	if cloneURL, err := url.Parse(rs.cloneURL); err == nil {
+		repo, _, err = vs.Repository(rs.vcsType, cloneURL, func(costlyOp) error { return errNotInStore })
+		if err != nil {
+			repo = nil
+		}
+	}
+	notifyAffected(repo, rs, change.ID, change.Event)
+}
@@ -0,0 +1,54 @@
+package page
+
+import (
+	"fmt"
+	"strings"
+)
+
+// OutdatedEvent is sent to the frontend when the branch being viewed was updated.
+type OutdatedEvent struct {
+	Branch      string
+	OldCommitID string // Empty if the branch is new.
+	NewCommitID string // Empty if the branch was deleted.
+	NewCommits  int    // Number of new commits, or 0 if unknown.
+	Summary     string // First line of the newest commit message.
+
+	// PackageChanged reports whether files in the viewed package are known to have changed.
+	// Viewers of packages that are known not to have changed aren't sent the event.
+	PackageChanged bool
+}
+
+// Description returns a human-readable description of the event.
+func (e OutdatedEvent) Description() string {
+	if e.NewCommitID == "" {
+		return "This branch was deleted."
+	}
+	var buf strings.Builder
+	switch e.NewCommits {
+	case 0:
+		buf.WriteString("New commits")
+	case 1:
+		buf.WriteString("1 new commit")
+	default:
+		fmt.Fprintf(&buf, "%d new commits", e.NewCommits)
+	}
+	if e.PackageChanged {
+		buf.WriteString(", this package changed.")
+	} else {
+		buf.WriteString(".")
+	}
+	if e.Summary != "" {
+		fmt.Fprintf(&buf, " Latest: %q.", e.Summary)
+	}
+	return buf.String()
+}
+
+// EventMessage is sent to the frontend over WebSocket and long polling,
+// which don't have event IDs built in, unlike EventSource.
+type EventMessage struct {
+	// ID is the ID of Event. If Event is nil, it's the ID of the last event
+	// sent before the connection was opened, or empty for a heartbeat.
+	// It's sent back as LastEventID query parameter when reconnecting.
+	ID    string
+	Event *OutdatedEvent
+}
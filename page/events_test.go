@@ -0,0 +1,24 @@
+package page_test
+
+import (
+	"fmt"
+
+	"github.com/shurcooL/gtdo/page"
+)
+
+func ExampleOutdatedEvent_Description() {
+	events := []page.OutdatedEvent{
+		{Branch: "master", OldCommitID: "a", NewCommitID: "b", NewCommits: 3, Summary: "Fix typo.", PackageChanged: true},
+		{Branch: "master", OldCommitID: "a", NewCommitID: "b", NewCommits: 1},
+		{Branch: "feature", NewCommitID: "b", PackageChanged: true},
+		{Branch: "feature", OldCommitID: "a"},
+	}
+	for _, e := range events {
+		fmt.Println(e.Description())
+	}
+	// Output:
+	// 3 new commits, this package changed. Latest: "Fix typo.".
+	// 1 new commit.
+	// New commits, this package changed.
+	// This branch was deleted.
+}
@@ -29,6 +29,7 @@ func Tabs(path string, rawQuery string) template.HTML {
 		{id: "", name: "Code", icon: octicon.Code},
 		{id: "imports", name: "Imports"},
 		{id: "dependents", name: "Dependents"},
+		{id: "api", name: "API", beta: true},
 	} {
 		a := &html.Node{Type: html.ElementNode, Data: atom.A.String()}
 		aClass := "tabnav-tab"
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shurcooL/gtdo/internal/ratelimit"
+)
+
+var (
+	trustedProxiesFlag = flag.String("trusted-proxies", "", "Comma-separated list of CIDRs of trusted reverse proxies. The client IP header is only honored for requests from them.")
+	clientIPHeaderFlag = flag.String("client-ip-header", "X-Forwarded-For", "Header that trusted reverse proxies use to pass the client IP.")
+
+	pageLimitFlag      = limitFlag{Rate: 120.0 / 60, Burst: 120}
+	fetchLimitFlag     = limitFlag{Rate: 30.0 / 3600, Burst: 30}
+	cloneLimitFlag     = limitFlag{Rate: 10.0 / 3600, Burst: 10}
+	typeCheckLimitFlag = limitFlag{Rate: 60.0 / 3600, Burst: 60}
+)
+
+func init() {
+	flag.Var(&pageLimitFlag, "page-limit", `Per-client limit of page requests, as "count/duration" (e.g., "120/1m"). Empty means unlimited.`)
+	flag.Var(&fetchLimitFlag, "fetch-limit", `Per-client limit of fetches of new commits into existing repositories, as "count/duration".`)
+	flag.Var(&cloneLimitFlag, "clone-limit", `Per-client limit of clones of new repositories, as "count/duration".`)
+	flag.Var(&typeCheckLimitFlag, "type-check-limit", `Per-client limit of packages type-checked for the API tab, as "count/duration".`)
+}
+
+// clientLimits are per-client budgets for requests and the costly operations they cause.
+type clientLimits struct {
+	pages      *ratelimit.Limiter // Page requests, served from repositories already in the vcs store.
+	fetches    *ratelimit.Limiter // Fetches of new commits.
+	clones     *ratelimit.Limiter // Clones of new repositories.
+	typeChecks *ratelimit.Limiter // Packages type-checked for the API tab.
+}
+
+func newClientLimits() *clientLimits {
+	return &clientLimits{
+		pages:      ratelimit.New(ratelimit.Limit(pageLimitFlag)),
+		fetches:    ratelimit.New(ratelimit.Limit(fetchLimitFlag)),
+		clones:     ratelimit.New(ratelimit.Limit(cloneLimitFlag)),
+		typeChecks: ratelimit.New(ratelimit.Limit(typeCheckLimitFlag)),
+	}
+}
+
+// Spend spends a token from the budget of client ip for op.
+// It returns a *rateLimitError if the budget is exhausted.
+func (l *clientLimits) Spend(ip string, op costlyOp) error {
+	var limiter *ratelimit.Limiter
+	switch op {
+	case opClone:
+		limiter = l.clones
+	case opFetch:
+		limiter = l.fetches
+	case opTypeCheck:
+		limiter = l.typeChecks
+	default:
+		panic(fmt.Errorf("unexpected costlyOp: %v", op))
+	}
+	if ok, retryAfter := limiter.Allow(ip); !ok {
+		log.Printf("rate limited %v for client %v\n", op, ip)
+		return &rateLimitError{Op: op, RetryAfter: retryAfter}
+	}
+	return nil
+}
+
+// rateLimitError is returned when a costly operation was not
+// performed because the client has exceeded its budget.
+type rateLimitError struct {
+	Op         costlyOp
+	RetryAfter time.Duration
+}
+
+func (e *rateLimitError) Error() string {
+	return fmt.Sprintf("too many requests that need to %v, please retry later", e.Op)
+}
+
+// trustedProxies is the parsed value of -trusted-proxies flag.
+var trustedProxies []*net.IPNet
+
+func parseTrustedProxies(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, cidr := range strings.Split(s, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// isTrustedProxy reports whether ip belongs to a trusted reverse proxy.
+func isTrustedProxy(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, n := range trustedProxies {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the IP address of the client that made req.
+//
+// If req comes from a trusted proxy, the client IP header is consulted.
+// Its right-most address that isn't a trusted proxy is used, since
+// addresses to the left of it can be set by the client arbitrarily.
+func clientIP(req *http.Request) string {
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		ip = req.RemoteAddr
+	}
+	if !isTrustedProxy(ip) {
+		return ip
+	}
+	hops := strings.Split(strings.Join(req.Header.Values(*clientIPHeaderFlag), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		ip = hop
+		if !isTrustedProxy(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// tooManyRequests replies to the request with 429 Too Many Requests,
+// and a Retry-After header set to retryAfter.
+func tooManyRequests(w http.ResponseWriter, retryAfter time.Duration, msg string) {
+	seconds := int64(retryAfter/time.Second) + 1
+	w.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+	http.Error(w, "429 Too Many Requests\n\n"+msg, http.StatusTooManyRequests)
+}
+
+// limitFlag is a flag.Value for a ratelimit.Limit, specified as "count/duration".
+type limitFlag ratelimit.Limit
+
+func (l *limitFlag) Set(s string) error {
+	if s == "" {
+		*l = limitFlag{}
+		return nil
+	}
+	i := strings.Index(s, "/")
+	if i == -1 {
+		return fmt.Errorf("limit %q is not of form count/duration", s)
+	}
+	count, err := strconv.Atoi(s[:i])
+	if err != nil {
+		return err
+	}
+	d, err := time.ParseDuration(s[i+1:])
+	if err != nil {
+		return err
+	}
+	if count <= 0 || d <= 0 {
+		return fmt.Errorf("limit %q must have positive count and duration", s)
+	}
+	*l = limitFlag{Rate: float64(count) / d.Seconds(), Burst: count}
+	return nil
+}
+
+func (l *limitFlag) String() string {
+	if l == nil || ratelimit.Limit(*l).Unlimited() {
+		return ""
+	}
+	d := time.Duration(float64(l.Burst) / l.Rate * float64(time.Second)).Round(time.Second)
+	return fmt.Sprintf("%d/%v", l.Burst, d)
+}
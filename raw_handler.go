@@ -0,0 +1,72 @@
+package main
+
+import (
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/shurcooL/gtdo/gtdo"
+)
+
+// rawURL returns the URL of the raw contents of file name, relative to the directory
+// of importPath, at revision rev. name may be in a subdirectory.
+func rawURL(importPath, name, rev string) *url.URL {
+	filename := path.Join(importPath, name)
+	query := url.Values{gtdo.RawQueryParameter: {path.Base(filename)}}
+	if rev != "" {
+		query.Set(gtdo.RevisionQueryParameter, rev)
+	}
+	return &url.URL{
+		Path:     "/" + path.Dir(filename),
+		RawQuery: query.Encode(),
+	}
+}
+
+// rawHandler serves the raw contents of file name in the directory of importPath at revision rev.
+// It's used for images and links in rendered files, like READMEs.
+func (h *handler) rawHandler(w http.ResponseWriter, req *http.Request, importPath, rev, name string) {
+	if name != path.Base(name) || name == "." || name == ".." {
+		http.Error(w, "400 Bad Request\n\nraw file name must not contain slashes", http.StatusBadRequest)
+		return
+	}
+
+	source, _, _, _, _, fs, _, _, err := try(importPath, rev, buildTargetFromQuery(req.URL.Query()), h.permit(req))
+	log.Println("using source:", source)
+	if err != nil {
+		log.Println("try:", err)
+		tryError(w, err)
+		return
+	}
+	if fs == nil {
+		http.NotFound(w, req)
+		return
+	}
+
+	filename := path.Join("/virtual-go-workspace/src", importPath, name)
+	fi, err := fs.Stat(filename)
+	if err != nil || fi.IsDir() {
+		http.NotFound(w, req)
+		return
+	}
+	f, err := fs.Open(filename)
+	if err != nil {
+		log.Println("fs.Open:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	// The contents come from the repository, so don't let them
+	// run scripts or be sniffed as something else on our origin.
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" || strings.HasPrefix(contentType, "text/html") {
+		contentType = "text/plain; charset=utf-8"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	http.ServeContent(w, req, name, fi.ModTime(), f)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/shurcooL/github_flavored_markdown"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"golang.org/x/tools/godoc/vfs"
+)
+
+// readmeNames are the names of README files that are rendered, in order of preference.
+var readmeNames = []string{"README.md", "README"}
+
+// readmeHTML renders the README file in the directory of importPath from fs.
+// It returns an empty result if there's no README file.
+// Relative links and images point to gtdo at revision rev, and
+// links to other directories keep the query parameters in rawQuery.
+func readmeHTML(fs vfs.FileSystem, importPath, repoImportPath, rev, rawQuery string) (template.HTML, error) {
+	for _, name := range readmeNames {
+		src, err := vfs.ReadFile(fs, path.Join("/virtual-go-workspace/src", importPath, name))
+		if err != nil {
+			continue
+		}
+		if path.Ext(name) != ".md" {
+			return template.HTML("<pre>" + template.HTMLEscapeString(string(src)) + "</pre>"), nil
+		}
+		l := readmeLinks{
+			fs:             fs,
+			importPath:     importPath,
+			repoImportPath: repoImportPath,
+			rev:            rev,
+			rawQuery:       rawQuery,
+		}
+		body, err := l.rewrite(github_flavored_markdown.Markdown(src))
+		if err != nil {
+			return "", err
+		}
+		return template.HTML(body), nil
+	}
+	return "", nil
+}
+
+// readmeLinks rewrites relative URLs in a rendered README file.
+type readmeLinks struct {
+	fs             vfs.FileSystem
+	importPath     string
+	repoImportPath string
+	rev            string
+	rawQuery       string
+}
+
+// rewrite rewrites relative links and images in HTML fragment body.
+func (l readmeLinks) rewrite(body []byte) ([]byte, error) {
+	context := &html.Node{Type: html.ElementNode, Data: "div", DataAtom: atom.Div}
+	nodes, err := html.ParseFragment(bytes.NewReader(body), context)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	for _, n := range nodes {
+		l.rewriteNode(n)
+		err := html.Render(&buf, n)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func (l readmeLinks) rewriteNode(n *html.Node) {
+	if n.Type == html.ElementNode {
+		for i, attr := range n.Attr {
+			switch {
+			case n.DataAtom == atom.A && attr.Key == "href":
+				n.Attr[i].Val = l.url(attr.Val, false)
+			case n.DataAtom == atom.Img && attr.Key == "src":
+				n.Attr[i].Val = l.url(attr.Val, true)
+			}
+		}
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		l.rewriteNode(c)
+	}
+}
+
+// url returns the gtdo URL for relative reference ref in the README file.
+// Directories are linked to their package pages, unless raw is true,
+// and files to their raw contents. Other references are returned unmodified.
+func (l readmeLinks) url(ref string, raw bool) string {
+	u, err := url.Parse(ref)
+	if err != nil || u.Scheme != "" || u.Host != "" || u.Path == "" || strings.HasPrefix(u.Path, "/") {
+		return ref
+	}
+	target := path.Join(l.importPath, u.Path)
+	if !packageInsideRepo(target, l.repoImportPath) {
+		return ref
+	}
+
+	isDir := strings.HasSuffix(u.Path, "/")
+	if fi, err := l.fs.Stat(path.Join("/virtual-go-workspace/src", target)); err == nil {
+		isDir = fi.IsDir()
+	}
+	switch {
+	case isDir && raw:
+		return ref
+	case isDir:
+		pkgURL, _ := url.Parse(string(importPathURL(target, l.repoImportPath, l.rawQuery)))
+		pkgURL.Fragment = u.Fragment
+		return pkgURL.String()
+	}
+
+	fileURL := rawURL(l.importPath, u.Path, l.rev)
+	fileURL.Fragment = u.Fragment
+	return fileURL.String()
+}
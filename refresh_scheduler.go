@@ -0,0 +1,193 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	refreshMinIntervalFlag = flag.Duration("refresh-min-interval", 5*time.Minute, "Minimum interval between scheduled refreshes of a popular repository.")
+	refreshMaxIntervalFlag = flag.Duration("refresh-max-interval", 24*time.Hour, "Maximum interval between scheduled refreshes of a viewed repository. Zero disables scheduled refreshes.")
+)
+
+// RefreshScheduler periodically enqueues updates of recently viewed repositories,
+// so that they're fresh by the time the next visitor arrives.
+var RefreshScheduler *refreshScheduler
+
+// priorityScheduled is the priority of a scheduled update. It's lower than
+// any update requested by a page viewer, since nobody is waiting for it.
+const priorityScheduled = 0
+
+const (
+	// viewHalfLife is the time it takes for a view to count half as much.
+	viewHalfLife = 24 * time.Hour
+
+	// minViews is the decayed view count below which a repository is forgotten.
+	minViews = 0.1
+)
+
+type refreshScheduler struct {
+	minInterval, maxInterval time.Duration
+
+	mu    sync.Mutex
+	repos map[repoSpec]*scheduledRepo
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// scheduledRepo tracks how popular and active a repository is.
+type scheduledRepo struct {
+	importPathRepoSpec
+	views       float64   // View count, decayed by viewHalfLife, as of lastView.
+	lastView    time.Time // Last time the repository was viewed.
+	lastChange  time.Time // Last time an update found changes. Zero if never.
+	lastRefresh time.Time // Last time an update was enqueued or done.
+}
+
+// NewRefreshScheduler starts a refresh scheduler. Repositories are refreshed no more often
+// than minInterval, and no less often than maxInterval while they're being viewed.
+// If maxInterval is zero, the scheduler only tracks views but never enqueues updates.
+func NewRefreshScheduler(minInterval, maxInterval time.Duration) *refreshScheduler {
+	rs := &refreshScheduler{
+		minInterval: minInterval,
+		maxInterval: maxInterval,
+		repos:       make(map[repoSpec]*scheduledRepo),
+		stop:        make(chan struct{}),
+	}
+	if maxInterval > 0 {
+		rs.wg.Add(1)
+		go rs.run()
+	}
+	return rs
+}
+
+// Close stops the scheduler.
+func (rs *refreshScheduler) Close() error {
+	close(rs.stop)
+	rs.wg.Wait()
+	return nil
+}
+
+// Viewed records a view of a package in the repository.
+// It's safe to call this concurrently.
+func (rs *refreshScheduler) Viewed(repo importPathRepoSpec) {
+	now := time.Now()
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	r, ok := rs.repos[repo.repoSpec]
+	if !ok {
+		// Not refreshed by us yet, but it was just fetched or resolved by the page view.
+		r = &scheduledRepo{lastRefresh: now}
+		rs.repos[repo.repoSpec] = r
+	}
+	r.importPathRepoSpec = repo
+	r.views = r.viewsAt(now) + 1
+	r.lastView = now
+}
+
+// Updated records that the repository was updated, and whether that found any changes.
+// It's safe to call this concurrently.
+func (rs *refreshScheduler) Updated(repo repoSpec, changed bool) {
+	now := time.Now()
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	r, ok := rs.repos[repo]
+	if !ok {
+		return
+	}
+	r.lastRefresh = now
+	if changed {
+		r.lastChange = now
+	}
+}
+
+// viewsAt returns the view count decayed to time now.
+func (r *scheduledRepo) viewsAt(now time.Time) float64 {
+	return r.views * math.Exp2(-now.Sub(r.lastView).Seconds()/viewHalfLife.Seconds())
+}
+
+// interval returns how often the repository should be refreshed as of time now.
+// More popular repositories, and ones that changed recently, are refreshed more often.
+func (rs *refreshScheduler) interval(r *scheduledRepo, now time.Time) time.Duration {
+	interval := time.Duration(float64(rs.maxInterval) / (1 + r.viewsAt(now)))
+	switch sinceChange := now.Sub(r.lastChange); {
+	case r.lastChange.IsZero():
+		// No changes seen yet, nothing to adjust for.
+	case sinceChange < 24*time.Hour:
+		interval /= 4
+	case sinceChange < 7*24*time.Hour:
+		interval /= 2
+	case sinceChange > 30*24*time.Hour:
+		interval *= 2
+	}
+	if interval < rs.minInterval {
+		interval = rs.minInterval
+	}
+	if interval > rs.maxInterval {
+		interval = rs.maxInterval
+	}
+	return interval
+}
+
+func (rs *refreshScheduler) run() {
+	defer rs.wg.Done()
+
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for _, repo := range rs.due(time.Now()) {
+				RepoUpdater.Enqueue(repo, priorityScheduled)
+			}
+		case <-rs.stop:
+			return
+		}
+	}
+}
+
+// due returns repositories that are due for a refresh at time now,
+// and forgets ones that haven't been viewed in a long time.
+func (rs *refreshScheduler) due(now time.Time) []importPathRepoSpec {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	var due []importPathRepoSpec
+	for spec, r := range rs.repos {
+		if r.viewsAt(now) < minViews {
+			delete(rs.repos, spec)
+			continue
+		}
+		if now.Sub(r.lastRefresh) >= rs.interval(r, now) {
+			due = append(due, r.importPathRepoSpec)
+			r.lastRefresh = now
+		}
+	}
+	return due
+}
+
+// WriteStatus writes a human-readable status of scheduled repositories to w.
+func (rs *refreshScheduler) WriteStatus(w io.Writer) {
+	now := time.Now()
+
+	rs.mu.Lock()
+	var repos []*scheduledRepo
+	for _, r := range rs.repos {
+		repos = append(repos, r)
+	}
+	sort.Slice(repos, func(i, j int) bool { return repos[i].viewsAt(now) > repos[j].viewsAt(now) })
+	fmt.Fprintf(w, "scheduled repos (%d, most viewed first):\n", len(repos))
+	for _, r := range repos {
+		interval := rs.interval(r, now)
+		fmt.Fprintf(w, "\t%s %s - views %.1f, interval %v, next in %v\n", r.vcsType, r.cloneURL, r.viewsAt(now), interval, (interval - now.Sub(r.lastRefresh)).Round(time.Second))
+	}
+	rs.mu.Unlock()
+}
@@ -1,11 +1,14 @@
 package main
 
 import (
+	"bytes"
 	"errors"
+	"io/ioutil"
 	"os"
 	"path"
 	"strings"
 
+	"sourcegraph.com/sourcegraph/go-vcs/vcs"
 	"sourcegraph.com/sourcegraph/go-vcs/vcs/util"
 
 	"golang.org/x/tools/godoc/vfs"
@@ -106,3 +109,74 @@ func antibase(name string) string {
 	}
 	return name
 }
+
+// dirChanged reports whether the files directly inside dir differ
+// between commits oldID and newID of repo. Subdirectories are not considered.
+func dirChanged(repo vcs.Repository, dir string, oldID, newID vcs.CommitID) (bool, error) {
+	oldFS, err := repo.FileSystem(oldID)
+	if err != nil {
+		return false, err
+	}
+	newFS, err := repo.FileSystem(newID)
+	if err != nil {
+		return false, err
+	}
+	oldFiles, oldErr := readDirFiles(oldFS, dir)
+	newFiles, newErr := readDirFiles(newFS, dir)
+	switch {
+	case oldErr != nil && newErr != nil:
+		// Directory doesn't exist in either commit.
+		return false, nil
+	case oldErr != nil || newErr != nil:
+		// Directory was created or deleted.
+		return true, nil
+	case len(oldFiles) != len(newFiles):
+		return true, nil
+	}
+	for name, oldFI := range oldFiles {
+		newFI, ok := newFiles[name]
+		if !ok || newFI.Size() != oldFI.Size() {
+			return true, nil
+		}
+	}
+	for name := range oldFiles {
+		oldSrc, err := readFile(oldFS, path.Join(dir, name))
+		if err != nil {
+			return false, err
+		}
+		newSrc, err := readFile(newFS, path.Join(dir, name))
+		if err != nil {
+			return false, err
+		}
+		if !bytes.Equal(oldSrc, newSrc) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// readDirFiles returns the files directly inside dir, keyed by name.
+func readDirFiles(fs vfs.FileSystem, dir string) (map[string]os.FileInfo, error) {
+	fis, err := fs.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]os.FileInfo)
+	for _, fi := range fis {
+		if fi.IsDir() {
+			continue
+		}
+		files[fi.Name()] = fi
+	}
+	return files, nil
+}
+
+// readFile reads the file at path from fs.
+func readFile(fs vfs.FileSystem, path string) ([]byte, error) {
+	f, err := fs.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"strings"
+
+	"github.com/shurcooL/gtdo/internal/webhook"
+	go_vcs "golang.org/x/tools/go/vcs"
+)
+
+var webhookSecretFileFlag = flag.String("webhook-secret-file", "", "Optional path to file containing the secret for verifying push webhooks. If empty, webhooks are disabled.")
+
+// newWebhookHandler returns a handler for push webhooks that uses the secret in secretFile.
+func newWebhookHandler(secretFile string) (*webhook.Handler, error) {
+	secret, err := ioutil.ReadFile(secretFile)
+	if err != nil {
+		return nil, err
+	}
+	secret = []byte(strings.TrimSpace(string(secret)))
+	if len(secret) == 0 {
+		return nil, errors.New("webhook secret is empty")
+	}
+	return &webhook.Handler{
+		Secret: secret,
+		Push: func(push webhook.Push) {
+			go enqueuePush(push)
+		},
+	}, nil
+}
+
+// errNotInStore is used to prevent webhooks from cloning repositories
+// that aren't already in the vcs store.
+var errNotInStore = errors.New("repository is not in vcs store")
+
+// enqueuePush enqueues an update of the pushed repository,
+// if it's already in the vcs store.
+func enqueuePush(push webhook.Push) {
+	rr, err := go_vcs.RepoRootForImportPath(push.ImportPath, false)
+	if err != nil {
+		log.Println("enqueuePush: RepoRootForImportPath:", err)
+		return
+	}
+	if rr.VCS.Cmd != "git" && rr.VCS.Cmd != "hg" {
+		log.Println("enqueuePush: unsupported rr.VCS.Cmd:", rr.VCS.Cmd)
+		return
+	}
+	u, err := url.Parse(rr.Repo)
+	if err != nil {
+		log.Println("enqueuePush:", err)
+		return
+	}
+	_, _, err = vs.Repository(rr.VCS.Cmd, u, func(costlyOp) error { return errNotInStore })
+	if err != nil {
+		log.Printf("enqueuePush: skipping %s: %v\n", rr.Root, err)
+		return
+	}
+
+	log.Printf("enqueuePush: %s was pushed to (ref %q)\n", rr.Root, push.Ref)
+	RepoUpdater.Enqueue(importPathRepoSpec{
+		importPath: rr.Root,
+		repoSpec:   repoSpec{vcsType: rr.VCS.Cmd, cloneURL: rr.Repo},
+	}, priorityRefresh)
+}